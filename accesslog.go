@@ -0,0 +1,217 @@
+package goserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultAccessLogFormat is used when an access log doesn't specify a format.
+const defaultAccessLogFormat = `$remote_addr - [$time_local] "$request" $status $bytes_sent $request_time`
+
+// AccessLog describes where and how requests are logged.
+//
+// The format may contain the following tokens, which are substituted for
+// each request: $remote_addr, $time_local, $request, $method, $uri, $status,
+// $bytes_sent, $request_time, $http_referer, $http_user_agent and
+// $request_id. It's ignored when logging JSON, in which case all of these are
+// included.
+//
+// Log files can be rotated, renaming them with the time appended, once they
+// reach a maximum size. The number and age of the rotated files kept can be
+// limited. Files can also be gzipped as they're written.
+type AccessLog struct {
+	Path   string `yaml:"path"`             // file path, "stdout" or "stderr"
+	Format string `yaml:"format,omitempty"` // line format
+
+	MaxSize    string `yaml:"max-size,omitempty"`    // rotate once this size, e.g. "100MB"; never if unset
+	MaxAge     string `yaml:"max-age,omitempty"`     // remove rotated files older than this, e.g. "720h"
+	MaxBackups int    `yaml:"max-backups,omitempty"` // number of rotated files kept; all if unset
+	Gzip       bool   `yaml:"gzip,omitempty"`        // compress the file, and so its rotated files
+}
+
+func (a *AccessLog) sanitise() {
+	if a.Format == "" {
+		a.Format = defaultAccessLogFormat
+	}
+}
+
+func (a AccessLog) check(label string) (ok bool) {
+	ok = true
+	if a.Path == "" {
+		log.Println(label + ": no access log path specified")
+		ok = false
+	}
+	ok = checkSize(label, "max size", a.MaxSize) && ok
+	ok = checkDuration(label, "max age", a.MaxAge) && ok
+	if a.MaxBackups < 0 {
+		log.Printf(label+": invalid max backups %d", a.MaxBackups)
+		ok = false
+	}
+	if (a.Path == "stdout" || a.Path == "stderr") && (a.MaxSize != "" || a.MaxAge != "" || a.MaxBackups != 0 || a.Gzip) {
+		log.Println(label + ": rotation and gzip options require a log file")
+		ok = false
+	}
+	return
+}
+
+// open opens the log's destination, returning a logger writing to it. Files
+// already opened for other logs, as recorded in files, are shared with them.
+func (a AccessLog) open(files map[string]*rotatingFile) (*AccessLogger, error) {
+	var w io.Writer
+	switch a.Path {
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	default:
+		f := files[a.Path]
+		if f == nil {
+			maxSize, _ := parseSize(a.MaxSize)
+			maxAge, _ := time.ParseDuration(a.MaxAge)
+			var err error
+			if f, err = openRotatingFile(a.Path, maxSize, maxAge, a.MaxBackups, a.Gzip); err != nil {
+				return nil, err
+			}
+			files[a.Path] = f
+		}
+		w = f
+	}
+	return &AccessLogger{w: w, format: a.Format, json: jsonLogs}, nil
+}
+
+// AccessLogger writes formatted access log lines.
+type AccessLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	json   bool // write JSON objects rather than formatted lines
+}
+
+// accessLogEntry describes a completed request, as written in JSON.
+type accessLogEntry struct {
+	jsonLogEntry
+	RemoteAddr    string  `json:"remote_addr"`
+	Method        string  `json:"method"`
+	URI           string  `json:"uri"`
+	Proto         string  `json:"proto"`
+	Status        int     `json:"status"`
+	BytesSent     int64   `json:"bytes_sent"`
+	RequestTime   float64 `json:"request_time"`
+	HTTPReferer   string  `json:"http_referer,omitempty"`
+	HTTPUserAgent string  `json:"http_user_agent,omitempty"`
+	RequestID     string  `json:"request_id,omitempty"`
+}
+
+// Log writes a line describing the completed request.
+func (l *AccessLogger) Log(r *http.Request, status int, bytes int64, elapsed time.Duration) {
+	info := GetRequestInfo(r)
+	remoteAddr := r.RemoteAddr
+	if info.ClientIP != nil {
+		remoteAddr = info.ClientIP.String()
+	}
+
+	if l.json {
+		line, err := json.Marshal(accessLogEntry{
+			jsonLogEntry: jsonLogEntry{
+				Time:  time.Now().Format(time.RFC3339Nano),
+				Level: "info",
+				Msg:   "request",
+			},
+			RemoteAddr:    remoteAddr,
+			Method:        r.Method,
+			URI:           r.RequestURI,
+			Proto:         r.Proto,
+			Status:        status,
+			BytesSent:     bytes,
+			RequestTime:   elapsed.Seconds(),
+			HTTPReferer:   r.Referer(),
+			HTTPUserAgent: r.UserAgent(),
+			RequestID:     info.ID,
+		})
+		if err != nil {
+			return
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.w.Write(append(line, '\n'))
+		return
+	}
+
+	line := os.Expand(l.format, func(token string) string {
+		switch token {
+		case "remote_addr":
+			return remoteAddr
+		case "time_local":
+			return time.Now().Format("02/Jan/2006:15:04:05 -0700")
+		case "request":
+			return r.Method + " " + r.RequestURI + " " + r.Proto
+		case "method":
+			return r.Method
+		case "uri":
+			return r.RequestURI
+		case "status":
+			return strconv.Itoa(status)
+		case "bytes_sent":
+			return strconv.FormatInt(bytes, 10)
+		case "request_time":
+			return fmt.Sprintf("%.3f", elapsed.Seconds())
+		case "http_referer":
+			return r.Referer()
+		case "http_user_agent":
+			return r.UserAgent()
+		case "request_id":
+			return info.ID
+		}
+		return ""
+	})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(l.w, line)
+}
+
+// LoggingResponseWriter records the status and size of a response.
+type LoggingResponseWriter struct {
+	http.ResponseWriter
+	Status int
+	Bytes  int64
+}
+
+func (w *LoggingResponseWriter) WriteHeader(status int) {
+	if w.Status == 0 {
+		w.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *LoggingResponseWriter) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.Bytes += int64(n)
+	return n, err
+}
+
+// AccessLogHandler logs each request to logger once it has been served.
+func AccessLogHandler(h http.Handler, logger *AccessLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &LoggingResponseWriter{ResponseWriter: w}
+		defer func() {
+			status := lw.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			logger.Log(r, status, lw.Bytes, time.Since(start))
+		}()
+		h.ServeHTTP(lw, r)
+	})
+}
@@ -0,0 +1,62 @@
+package goserve
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDRs parses a list of networks in CIDR notation. Plain IP addresses
+// are also accepted, and treated as networks of a single address.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address `%s`", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// containsIP returns true if ip is within any of the networks.
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPFilterHandler responds with `403 Forbidden` to clients whose address is
+// in deny, or not in allow when allow is non-empty. Addresses in allow are
+// permitted even if also in deny.
+func IPFilterHandler(h http.Handler, allow, deny []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := GetRequestInfo(r).ClientIP
+		if ip == nil {
+			ip = remoteIP(r)
+		}
+		permitted := ip != nil && containsIP(allow, ip) ||
+			len(allow) == 0 && !(ip != nil && containsIP(deny, ip))
+		if !permitted {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,70 @@
+package goserve
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME describes certificates to be obtained, and renewed, automatically from
+// Let's Encrypt.
+type ACME struct {
+	Domains  []string `yaml:"domains"`         // domains to obtain certificates for
+	CacheDir string   `yaml:"cache-dir"`       // where certificates are kept between restarts
+	Email    string   `yaml:"email,omitempty"` // contact address for the CA
+}
+
+func (a ACME) check(label string) (ok bool) {
+	ok = true
+	if len(a.Domains) == 0 {
+		log.Println(label + ": no ACME domains specified")
+		ok = false
+	}
+	for _, d := range a.Domains {
+		if strings.TrimSpace(d) == "" {
+			log.Println(label + ": empty ACME domain")
+			ok = false
+		}
+	}
+	if a.CacheDir == "" {
+		log.Println(label + ": no ACME cache directory specified")
+		ok = false
+	}
+	return
+}
+
+// manager returns a certificate manager for the domains, accepting the CA's
+// terms of service.
+func (a ACME) manager() *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(a.Domains...),
+		Cache:      autocert.DirCache(a.CacheDir),
+		Email:      a.Email,
+	}
+}
+
+// acmeChallengePrefix is the path under which HTTP-01 challenges are served.
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// ACMEChallengeHandler responds to ACME HTTP-01 challenges for the domains in
+// managers, using the manager responsible for the requested host. All other
+// requests are passed on to h.
+func ACMEChallengeHandler(h http.Handler, managers map[string]*autocert.Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePrefix) {
+			host := r.Host
+			if hostname, _, err := net.SplitHostPort(host); err == nil {
+				host = hostname
+			}
+			if m, found := managers[strings.ToLower(host)]; found {
+				m.HTTPHandler(nil).ServeHTTP(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
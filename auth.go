@@ -0,0 +1,122 @@
+package goserve
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth describes the credentials required to access a serve, given either
+// as a single username and password, or as an htpasswd file.
+type Auth struct {
+	Realm    string `yaml:"realm,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Htpasswd string `yaml:"htpasswd,omitempty"` // path to htpasswd file
+}
+
+func (a *Auth) sanitise() {
+	if a.Realm == "" {
+		a.Realm = "Restricted"
+	}
+}
+
+func (a Auth) check(label string) (ok bool) {
+	ok = true
+	if a.Htpasswd != "" {
+		if a.Username != "" || a.Password != "" {
+			log.Println(label + ": auth specifies both htpasswd and username/password")
+			ok = false
+		}
+		if _, err := readHtpasswd(a.Htpasswd); err != nil {
+			log.Printf(label+": couldn't load htpasswd file `%s`: %s", a.Htpasswd, err)
+			ok = false
+		}
+	} else if a.Username == "" || a.Password == "" {
+		log.Println(label + ": auth requires a username and password, or htpasswd")
+		ok = false
+	}
+	return
+}
+
+// credentials returns the function used to verify a username and password.
+func (a Auth) credentials() (func(user, pass string) bool, error) {
+	if a.Htpasswd == "" {
+		return func(user, pass string) bool {
+			// Compare both, regardless of outcome, to avoid leaking which
+			// was incorrect
+			u := subtle.ConstantTimeCompare([]byte(user), []byte(a.Username))
+			p := subtle.ConstantTimeCompare([]byte(pass), []byte(a.Password))
+			return u&p == 1
+		}, nil
+	}
+
+	users, err := readHtpasswd(a.Htpasswd)
+	if err != nil {
+		return nil, err
+	}
+	return func(user, pass string) bool {
+		hash, f := users[user]
+		return f && checkHtpasswdHash(hash, pass)
+	}, nil
+}
+
+// readHtpasswd reads an htpasswd file into a map of usernames to password
+// hashes. Only bcrypt (`$2y$...`) and SHA-1 (`{SHA}...`) hashes are supported.
+func readHtpasswd(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: malformed entry", n)
+		}
+		if !strings.HasPrefix(parts[1], "$2") && !strings.HasPrefix(parts[1], "{SHA}") {
+			return nil, fmt.Errorf("line %d: unsupported hash for user `%s`", n, parts[0])
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, scanner.Err()
+}
+
+// checkHtpasswdHash returns true if pass matches the htpasswd hash.
+func checkHtpasswdHash(hash, pass string) bool {
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(pass))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+}
+
+// BasicAuthHandler requires requests to carry credentials accepted by valid,
+// responding with `401 Unauthorized` otherwise.
+func BasicAuthHandler(h http.Handler, realm string, valid func(user, pass string) bool) http.Handler {
+	challenge := fmt.Sprintf("Basic realm=%q", realm)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || !valid(user, pass) {
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
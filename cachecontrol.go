@@ -0,0 +1,83 @@
+package goserve
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// CacheControl maps file extensions (e.g. ".js") and file name patterns
+// (e.g. "*.min.js") to Cache-Control header values. The value for "default"
+// (or "") applies to files matching nothing else.
+type CacheControl map[string]string
+
+func (c CacheControl) check(label string) (ok bool) {
+	ok = true
+	for key := range c {
+		if _, err := path.Match(key, ""); err != nil {
+			log.Printf(label+": invalid cache control pattern `%s`", key)
+			ok = false
+		}
+	}
+	return
+}
+
+// matcher returns a function that finds the value for a file name. Patterns
+// are tried first, in lexical order, followed by the extension, then the
+// default.
+func (c CacheControl) matcher() func(name string) string {
+	var patterns []string
+	exts := make(map[string]string)
+	def := ""
+	for key, value := range c {
+		switch {
+		case key == "" || key == "default":
+			def = value
+		case strings.HasPrefix(key, ".") && !strings.ContainsAny(key, `*?[\`):
+			exts[strings.ToLower(key)] = value
+		default:
+			patterns = append(patterns, key)
+		}
+	}
+	sort.Strings(patterns)
+
+	return func(name string) string {
+		base := path.Base(name)
+		if name == "" || strings.HasSuffix(name, "/") {
+			base = "index.html" // directories are served by their index
+		}
+		for _, p := range patterns {
+			if matched, _ := path.Match(p, base); matched {
+				return c[p]
+			}
+		}
+		if value, found := exts[strings.ToLower(path.Ext(base))]; found {
+			return value
+		}
+		return def
+	}
+}
+
+// CacheControlHandler sets the Cache-Control header on successful (and not
+// modified) responses according to the requested file's name, overriding any
+// set by outer handlers.
+func CacheControlHandler(h http.Handler, c CacheControl) http.Handler {
+	match := c.matcher()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := match(r.URL.Path)
+		if value == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(&HeaderHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(wh http.Header, status int) {
+				if status < 400 {
+					wh.Set("Cache-Control", value)
+				}
+			},
+		}, r)
+	})
+}
@@ -0,0 +1,232 @@
+// Command goserve serves static files as described by a config file or
+// command-line flags.
+package main
+
+import (
+	"gopkg.in/v1/yaml"
+
+	"github.com/johnsto/goserve"
+
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var cfg goserve.ServerConfig
+
+// configPath is the config file in use, if any
+var configPath string
+
+// quiet suppresses the startup summary
+var quiet bool
+
+// bestEffort serves on whichever listeners bind, rather than exiting if any
+// fail to
+var bestEffort bool
+
+// readyFD is written to, then closed, once all listeners are bound (unless
+// negative)
+var readyFD int
+
+func init() {
+	goserve.Version = version
+
+	flag.StringVar(&configPath, "config", "", "Path to configuration")
+	checkConfig := flag.Bool("config.check", false, "Check config then quit")
+	echoConfig := flag.Bool("config.echo", false, "Echo config then quit")
+	dumpConfig := flag.Bool("dump-config", false, "Print the config with defaults applied, without checking it, then quit")
+	flag.IntVar(&goserve.MaxListeners, "config.max-listeners", goserve.MaxListeners, "Maximum number of listeners")
+	flag.IntVar(&goserve.MaxServes, "config.max-serves", goserve.MaxServes, "Maximum number of serves")
+
+	indexes := flag.Bool("indexes", true, "Allow directory listing")
+	flag.BoolVar(&quiet, "quiet", false, "Don't log a summary of the config at startup")
+	noTargetCheck := flag.Bool("no-target-check", false, "Don't check that serve targets exist")
+	flag.BoolVar(&bestEffort, "best-effort", false, "Serve on whichever addresses can be bound, rather than exiting")
+	flag.IntVar(&readyFD, "ready-fd", -1, "File descriptor to write a newline to, then close, once listening")
+	flag.BoolVar(&goserve.Strict, "strict", false, "Treat overlapping paths as errors rather than warnings")
+	logFormat := flag.String("log-format", "", "Log format, text or json (overrides config)")
+	showVersion := flag.Bool("version", false, "Print version information then quit")
+
+	httpEnabled := flag.Bool("http", true, "Enable HTTP listener")
+	httpAddr := flag.String("http.addr", ":8080", "HTTP address")
+	httpGzip := flag.Bool("http.gzip", true, "Enable HTTP gzip compression")
+
+	httpsEnabled := flag.Bool("https", false, "Enable HTTPS listener")
+	httpsAddr := flag.String("https.addr", ":8443", "HTTPS address")
+	httpsGzip := flag.Bool("https.gzip", true, "Enable HTTPS gzip compression")
+	httpsKey := flag.String("https.key", "", "Path to HTTPS key")
+	httpsCert := flag.String("https.cert", "", "Path to HTTPS cert")
+
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionInfo())
+		os.Exit(0)
+	}
+	goserve.TargetCheck = !*noTargetCheck
+	if *logFormat != "" {
+		if !goserve.CheckLogFormat("Flags", *logFormat) {
+			os.Exit(2)
+		}
+		goserve.SetLogFormat(*logFormat)
+	}
+
+	if configPath == "" {
+		cfg.Listeners = []goserve.Listener{}
+
+		if *httpEnabled {
+			cfg.Listeners = append(cfg.Listeners, goserve.Listener{
+				Protocol: "http",
+				Addr:     *httpAddr,
+				Gzip:     *httpGzip,
+			})
+		}
+		if *httpsEnabled {
+			cfg.Listeners = append(cfg.Listeners, goserve.Listener{
+				Protocol: "https",
+				Addr:     *httpsAddr,
+				Gzip:     *httpsGzip,
+				KeyFile:  *httpsKey,
+				CertFile: *httpsCert,
+			})
+		}
+
+		// Serve from first path given on cmdline
+		target := flag.Arg(0)
+		if target == "" {
+			target = "."
+		}
+
+		cfg.Serves = []goserve.Serve{
+			goserve.Serve{
+				Path:    "/",
+				Target:  target,
+				Indexes: *indexes,
+			},
+		}
+	} else {
+		var err error
+		cfg, err = goserve.ReadServerConfig(configPath)
+		if err != nil {
+			log.Fatalf("Couldn't load config: %s. Exiting.\n", err)
+		}
+	}
+
+	if *logFormat != "" {
+		cfg.LogFormat = *logFormat
+	}
+	cfg.Sanitise()
+	goserve.SetLogFormat(cfg.LogFormat)
+
+	if *echoConfig || *dumpConfig {
+		b, err := yaml.Marshal(cfg)
+		if err != nil {
+			log.Fatalf("Couldn't encode config: %s. Exiting.\n", err)
+		}
+		if *dumpConfig {
+			// Escape `$` so the output reads back as the same config
+			os.Stdout.Write(bytes.Replace(b, []byte("$"), []byte("$$"), -1))
+			os.Exit(0)
+		}
+		print(string(b))
+	}
+
+	// Otherwise the config is checked when the server is created
+	if *echoConfig || *checkConfig {
+		if !cfg.Check() {
+			log.Fatalln("Invalid config. Exiting.")
+		}
+		if *checkConfig {
+			log.Println("Config check passed.")
+		}
+		os.Exit(0)
+	}
+}
+
+// notifyReady writes a newline to the file descriptor fd, then closes it, to
+// tell whoever started goserve (e.g. through a pipe) that it's listening.
+func notifyReady(fd int) {
+	f := os.NewFile(uintptr(fd), "ready-fd")
+	if f == nil {
+		log.Printf("Invalid ready file descriptor %d\n", fd)
+		return
+	}
+	if _, err := f.Write([]byte("\n")); err != nil {
+		log.Println("Couldn't notify readiness:", err)
+	}
+	f.Close()
+}
+
+// reload re-reads the config file, replacing the server's serves, errors and
+// redirects if it is valid. Changes to listeners require a restart.
+func reload(srv *goserve.Server) {
+	if configPath == "" {
+		log.Println("No config file to reload")
+		return
+	}
+	log.Printf("Reloading config from %s\n", configPath)
+	newCfg, err := goserve.ReadServerConfig(configPath)
+	if err != nil {
+		log.Println("Couldn't load config:", err)
+		return
+	}
+	if err := srv.Reload(newCfg); err != nil {
+		log.Printf("Couldn't reload config: %s. Keeping current config.\n", err)
+	}
+}
+
+func main() {
+	srv, err := goserve.NewServer(cfg)
+	if err != nil {
+		log.Fatalf("Couldn't start: %s. Exiting.\n", err)
+	}
+	if !quiet {
+		goserve.LogSummary(cfg)
+	}
+
+	srv.BestEffort = bestEffort
+	if err := srv.Start(); err != nil {
+		log.Fatalf("Couldn't start: %s. Exiting.\n", err)
+	}
+	if readyFD >= 0 {
+		notifyReady(readyFD)
+	}
+
+	// Since all the listeners are running in separate gorotines, we have to
+	// wait here for a termination signal, reloading the config and
+	// certificates, and rotating the access log, on SIGHUP. If a listener
+	// stops serving, there's nothing more to do.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+loop:
+	for {
+		select {
+		case err := <-srv.Errors():
+			log.Fatalf("Couldn't serve on %s. Exiting.\n", err)
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				break loop
+			}
+			if err := srv.ReloadCertificates(); err != nil {
+				log.Println("Couldn't reload certificates:", err)
+			}
+			if err := srv.RotateAccessLog(); err != nil {
+				log.Println("Couldn't rotate access log:", err)
+			}
+			reload(srv)
+		}
+	}
+
+	// The shutdown timeout starts once the drain delay is over
+	timeout, _ := time.ParseDuration(cfg.ShutdownTimeout)
+	drainDelay, _ := time.ParseDuration(cfg.DrainDelay)
+	timeout += drainDelay
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	srv.Shutdown(ctx)
+}
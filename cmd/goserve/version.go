@@ -0,0 +1,17 @@
+package main
+
+import "fmt"
+
+// Build information, set at build time with e.g.
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=abc123 -X main.buildDate=2006-01-02"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// versionInfo describes the running build, as printed by `-version`.
+func versionInfo() string {
+	return fmt.Sprintf("goserve %s (commit %s, built %s)", version, commit, buildDate)
+}
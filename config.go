@@ -1,12 +1,41 @@
-package main
+package goserve
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"html/template"
+	"io/ioutil"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Upper bounds on the number of listeners and serves a config may declare,
+// guarding against runaway (e.g. badly templated) configs.
+var (
+	MaxListeners = 256
+	MaxServes    = 4096
 )
 
+// TargetCheck enables checking that serve targets exist.
+var TargetCheck = true
+
+// Strict makes conflicts that would otherwise be warned about fatal.
+var Strict bool
+
 // Headers represents a simplified HTTP header dict
 type Headers map[string]string
 
@@ -16,35 +45,73 @@ type ServerConfig struct {
 	Serves    []Serve    `yaml:"serves"`
 	Errors    []Error    `yaml:"errors,omitempty"`
 	Redirects []Redirect `yaml:"redirects,omitempty"`
+	Include   []string   `yaml:"include,omitempty"` // further config files (globs allowed)
+
+	AccessLog       *AccessLog        `yaml:"access-log,omitempty"`
+	Metrics         *Metrics          `yaml:"metrics,omitempty"`
+	MIMETypes       map[string]string `yaml:"mime-types,omitempty"`     // extension to content type
+	HealthPath      string            `yaml:"health-path,omitempty"`    // liveness check path for all listeners
+	ReadinessPath   string            `yaml:"readiness-path,omitempty"` // readiness check path for all listeners
+	LogFormat       string            `yaml:"log-format,omitempty"`     // "text" (default) or "json"
+	MiddlewareOrder []string          `yaml:"middleware-order,omitempty"`
+	ShutdownTimeout string            `yaml:"shutdown-timeout,omitempty"`  // time allowed for requests to complete on shutdown
+	DrainDelay      string            `yaml:"drain-delay,omitempty"`       // time new requests are refused with 503 before listeners close on shutdown
+	RequestIDHeader string            `yaml:"request-id-header,omitempty"` // header carrying request IDs, e.g. X-Request-ID; none if unset
+
+	MaintenanceFile  string   `yaml:"maintenance-file,omitempty"`  // 503 all requests while this file exists
+	MaintenancePage  string   `yaml:"maintenance-page,omitempty"`  // served in maintenance mode, instead of the 503 error page
+	MaintenanceAllow []string `yaml:"maintenance-allow,omitempty"` // path prefixes still served in maintenance mode
 }
 
-func (c ServerConfig) sanitise() {
-	for _, l := range c.Listeners {
-		l.sanitise()
+// Sanitise fills in defaults for any options left unset.
+func (c *ServerConfig) Sanitise() {
+	if c.LogFormat == "" {
+		c.LogFormat = "text"
+	}
+	if c.ShutdownTimeout == "" {
+		c.ShutdownTimeout = "15s"
+	}
+	if c.AccessLog != nil {
+		c.AccessLog.sanitise()
+	}
+	if c.Metrics != nil {
+		c.Metrics.sanitise()
 	}
-	for _, s := range c.Serves {
-		s.sanitise()
+	for i := range c.Listeners {
+		c.Listeners[i].sanitise()
 	}
-	for _, r := range c.Redirects {
-		r.sanitise()
+	for i := range c.Serves {
+		c.Serves[i].sanitise()
 	}
-	for _, e := range c.Errors {
-		e.sanitise()
+	for i := range c.Redirects {
+		c.Redirects[i].sanitise()
+	}
+	for i := range c.Errors {
+		c.Errors[i].sanitise()
 	}
 }
 
-func (c ServerConfig) check() (ok bool) {
+// Check validates the config, logging any problems found, and returns true if
+// it's usable. It should be called after Sanitise.
+func (c ServerConfig) Check() (ok bool) {
 	ok = true
 	if len(c.Listeners) == 0 {
 		log.Printf("No listeners defined!")
 		ok = false
+	} else if len(c.Listeners) > MaxListeners {
+		log.Printf("Too many listeners defined (%d, maximum is %d)!", len(c.Listeners), MaxListeners)
+		ok = false
 	}
 	for i, l := range c.Listeners {
 		ok = l.check(fmt.Sprintf("Listener #%d", i)) && ok
 	}
+	ok = c.checkListenerAddresses() && ok
 	if len(c.Serves) == 0 {
 		log.Printf("No serves defined!")
 		ok = false
+	} else if len(c.Serves) > MaxServes {
+		log.Printf("Too many serves defined (%d, maximum is %d)!", len(c.Serves), MaxServes)
+		ok = false
 	}
 	for i, s := range c.Serves {
 		ok = s.check(fmt.Sprintf("Serve #%d", i)) && ok
@@ -52,64 +119,795 @@ func (c ServerConfig) check() (ok bool) {
 	for i, r := range c.Redirects {
 		ok = r.check(fmt.Sprintf("Redirect #%d", i)) && ok
 	}
+	for i, e := range c.Errors {
+		ok = e.check(fmt.Sprintf("Error #%d", i)) && ok
+	}
+	ok = c.checkDuplicates() && ok
+	ok = c.checkOverlaps() && ok
+	if c.AccessLog != nil {
+		ok = c.AccessLog.check("Access log") && ok
+	}
+	ok = c.checkAccessLogFiles() && ok
+	if c.Metrics != nil {
+		ok = c.Metrics.check("Metrics") && ok
+	}
+	ok = checkMIMETypes("Config", c.MIMETypes) && ok
+	ok = CheckLogFormat("Config", c.LogFormat) && ok
+	ok = checkMiddlewareOrder(c.MiddlewareOrder) && ok
+	ok = checkHealthPath("Config", "health path", c.HealthPath) && ok
+	ok = checkHealthPath("Config", "readiness path", c.ReadinessPath) && ok
+	ok = checkDuration("Config", "shutdown timeout", c.ShutdownTimeout) && ok
+	ok = checkDuration("Config", "drain delay", c.DrainDelay) && ok
+	if c.MaintenanceFile == "" && (c.MaintenancePage != "" || len(c.MaintenanceAllow) > 0) {
+		log.Println("Config: maintenance page or allowed paths specified without a maintenance file")
+		ok = false
+	}
+	if c.MaintenancePage != "" {
+		if fi, err := os.Stat(c.MaintenancePage); err != nil || !fi.Mode().IsRegular() {
+			log.Printf("Config: maintenance page `%s` does not exist", c.MaintenancePage)
+			ok = false
+		}
+	}
+	for _, p := range c.MaintenanceAllow {
+		if !strings.HasPrefix(p, "/") {
+			log.Printf("Config: maintenance allowed path `%s` must begin with /", p)
+			ok = false
+		}
+	}
+	if strings.ContainsAny(c.RequestIDHeader, " \t:") {
+		log.Printf("Config: invalid request ID header `%s`", c.RequestIDHeader)
+		ok = false
+	}
+	return
+}
+
+// checkAccessLogFiles returns true if access logs sharing a file agree on how
+// it's rotated and compressed.
+func (c ServerConfig) checkAccessLogFiles() (ok bool) {
+	ok = true
+	logs := []*AccessLog{c.AccessLog}
+	for _, l := range c.Listeners {
+		logs = append(logs, l.AccessLog)
+	}
+	files := make(map[string]*AccessLog)
+	for _, a := range logs {
+		if a == nil || a.Path == "stdout" || a.Path == "stderr" {
+			continue
+		}
+		if other, found := files[a.Path]; found && (a.MaxSize != other.MaxSize ||
+			a.MaxAge != other.MaxAge || a.MaxBackups != other.MaxBackups || a.Gzip != other.Gzip) {
+			log.Printf("Access logs sharing file `%s` have different rotation or gzip options", a.Path)
+			ok = false
+		}
+		files[a.Path] = a
+	}
+	return
+}
+
+// checkDuplicates reports serves for the same path (and host) as an earlier
+// serve, and errors for a status already handled, which can't both be
+// registered.
+func (c ServerConfig) checkDuplicates() (ok bool) {
+	ok = true
+	type route struct {
+		internal   bool
+		host, path string
+	}
+	serves := make(map[route]int)
+	for i, s := range c.Serves {
+		key := route{s.Internal, strings.ToLower(s.Host), s.Path}
+		if j, found := serves[key]; found {
+			log.Printf("Serve #%d: path `%s` is already served by serve #%d", i, s.Path, j)
+			ok = false
+			continue
+		}
+		serves[key] = i
+	}
+	statuses := make(map[int]int)
+	for i, e := range c.Errors {
+		if j, found := statuses[e.Status]; found {
+			log.Printf("Error #%d: status %d is already handled by error #%d", i, e.Status, j)
+			ok = false
+			continue
+		}
+		statuses[e.Status] = i
+	}
 	return
 }
 
+// checkOverlaps warns of redirects from paths already handled by a serve or
+// an earlier redirect, which are ignored. In strict mode these are errors.
+func (c ServerConfig) checkOverlaps() (ok bool) {
+	ok = true
+	for i, r := range c.Redirects {
+		if r.Regex {
+			continue
+		}
+		conflict := ""
+		for j, s := range c.Serves {
+			if s.Host == "" && !s.Internal && s.Path == r.From {
+				conflict = fmt.Sprintf("Serve #%d", j)
+				break
+			}
+		}
+		for j := 0; j < i && conflict == ""; j++ {
+			if !c.Redirects[j].Regex && c.Redirects[j].From == r.From {
+				conflict = fmt.Sprintf("Redirect #%d", j)
+			}
+		}
+		if conflict == "" {
+			continue
+		}
+		if Strict {
+			log.Printf("Redirect #%d: from `%s` overlaps %s", i, r.From, conflict)
+			ok = false
+		} else {
+			log.Printf("Warning: Redirect #%d: from `%s` overlaps %s, so will be ignored", i, r.From, conflict)
+		}
+	}
+	return
+}
+
+// checkListenerAddresses reports addresses shared by listeners, which would
+// fail to bind. Equivalent forms of TCP addresses, such as ":8080" and
+// "0.0.0.0:8080", are treated as the same address.
+func (c ServerConfig) checkListenerAddresses() (ok bool) {
+	ok = true
+	type use struct {
+		listener int
+		addr     string
+	}
+	seen := make(map[string]use)
+	for i, l := range c.Listeners {
+		for _, addr := range l.addresses() {
+			key := canonicalAddr(l.Protocol, addr)
+			prev, found := seen[key]
+			if !found {
+				seen[key] = use{i, addr}
+				continue
+			}
+			if prev.listener == i && prev.addr == addr {
+				continue // already reported by the listener's own check
+			}
+			log.Printf("Listener #%d: address `%s` is already used by listener #%d (`%s`)", i, addr, prev.listener, prev.addr)
+			ok = false
+		}
+	}
+	return
+}
+
+// canonicalAddr returns a key identifying the socket a listener would bind
+// for addr. HTTP and HTTPS listeners share TCP ports, so are treated alike.
+func canonicalAddr(protocol, addr string) string {
+	if isFDAddr(addr) {
+		if n, err := parseFDAddr(addr); err == nil {
+			return fmt.Sprintf("fd %d", n)
+		}
+		return addr
+	}
+	if protocol == "unix" {
+		return "unix " + filepath.Clean(addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp " + addr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = ""
+	}
+	if n, err := net.LookupPort("tcp", port); err == nil {
+		port = strconv.Itoa(n)
+	}
+	return "tcp " + net.JoinHostPort(strings.ToLower(host), port)
+}
+
+// validHost returns true if host is a host name or IPv4 address, optionally
+// prefixed with "*." to match its subdomains.
+func validHost(host string) bool {
+	for _, label := range strings.Split(strings.TrimPrefix(host, "*."), ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, c := range label {
+			if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkDuration returns true if value is empty or a valid duration.
+func checkDuration(label, name, value string) bool {
+	if value == "" {
+		return true
+	}
+	if _, err := time.ParseDuration(value); err != nil {
+		log.Printf(label+": invalid %s `%s`", name, value)
+		return false
+	}
+	return true
+}
+
+// checkHeaders returns true if the names of headers to be set, forced or
+// removed are valid, and no header is in more than one of them, since which
+// takes effect would be unclear.
+func checkHeaders(label string, headers, force Headers, remove []string) (ok bool) {
+	ok = true
+	option := make(map[string]string)
+	add := func(name, opt string) {
+		if name == "" || strings.ContainsAny(name, " \t:") {
+			log.Printf(label+": invalid header name `%s` in %s", name, opt)
+			ok = false
+			return
+		}
+		key := http.CanonicalHeaderKey(name)
+		if other, found := option[key]; found {
+			log.Printf(label+": header `%s` is in both %s and %s (headers only sets missing headers, force-headers replaces existing values and remove-headers removes them)", name, other, opt)
+			ok = false
+		}
+		option[key] = opt
+	}
+	for name := range headers {
+		add(name, "headers")
+	}
+	for name := range force {
+		add(name, "force-headers")
+	}
+	for _, name := range remove {
+		add(name, "remove-headers")
+	}
+	return
+}
+
+// checkMIMETypes returns true if types maps extensions (beginning with a
+// dot) to valid content types.
+func checkMIMETypes(label string, types map[string]string) (ok bool) {
+	ok = true
+	for ext, contentType := range types {
+		if !strings.HasPrefix(ext, ".") {
+			log.Printf(label+": MIME type extension `%s` must begin with a dot", ext)
+			ok = false
+		}
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			log.Printf(label+": invalid MIME type `%s` for `%s`", contentType, ext)
+			ok = false
+		}
+	}
+	return
+}
+
+// sizeUnits maps the suffixes accepted by parseSize to multipliers.
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a human-readable size such as "512", "64KB" or "10MB".
+// Units are powers of 1024, and case-insensitive.
+func parseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, u.suffix))
+			multiplier = u.bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size `%s`", s)
+	}
+	return n * multiplier, nil
+}
+
+// checkSize returns true if value is empty or a valid size.
+func checkSize(label, name, value string) bool {
+	if value == "" {
+		return true
+	}
+	if _, err := parseSize(value); err != nil {
+		log.Printf(label+": invalid %s `%s`", name, value)
+		return false
+	}
+	return true
+}
+
 // Listener describes how connections are accepted and the protocol used.
 type Listener struct {
-	Protocol string  `yaml:"protocol"`
-	Addr     string  `yaml:"addr"`
-	CertFile string  `yaml:"cert,omitempty"`
-	KeyFile  string  `yaml:"key,omitempty"`
-	Headers  Headers `yaml:"headers,omitempty"` // custom headers
-	Gzip     bool    `yaml:"gzip"`
+	Protocol string   `yaml:"protocol"`
+	Addr     string   `yaml:"addr"`
+	Addrs    []string `yaml:"addrs,omitempty"` // further addresses sharing the same settings
+	CertFile string   `yaml:"cert,omitempty"`
+	KeyFile  string   `yaml:"key,omitempty"`
+	Headers  Headers  `yaml:"headers,omitempty"` // custom headers
+	Gzip     bool     `yaml:"gzip"`
+	Brotli   bool     `yaml:"brotli,omitempty"`
+
+	ForceHeaders  Headers  `yaml:"force-headers,omitempty"`  // custom headers, replacing any existing values
+	RemoveHeaders []string `yaml:"remove-headers,omitempty"` // response headers to remove
+
+	Certificates  []Certificate `yaml:"certificates,omitempty"`    // further certs, chosen by SNI
+	ACME          *ACME         `yaml:"acme,omitempty"`            // obtain certs from Let's Encrypt instead
+	TLSMinVersion string        `yaml:"tls-min-version,omitempty"` // e.g. "1.2"
+	CipherSuites  []string      `yaml:"cipher-suites,omitempty"`   // crypto/tls names; TLS 1.3 suites aren't configurable
+	DisableHTTP2  bool          `yaml:"disable-http2,omitempty"`   // offer only HTTP/1.1 to TLS clients
+
+	// Client certificate authentication
+	ClientCA         string `yaml:"client-ca,omitempty"`          // CA bundle client certificates are verified against
+	ClientAuth       string `yaml:"client-auth,omitempty"`        // "request", "verify" or "require" (the default with client-ca)
+	ClientCertHeader string `yaml:"client-cert-header,omitempty"` // request header set to verified clients' common names
+
+	GzipOptions `yaml:",inline"`
+
+	AccessLog  *AccessLog `yaml:"access-log,omitempty"`  // overrides the global access log
+	RateLimit  *RateLimit `yaml:"rate-limit,omitempty"`  // per-client request rate limit
+	TrustProxy bool       `yaml:"trust-proxy,omitempty"` // take client address from X-Forwarded-For
+
+	ProxyProtocol bool `yaml:"proxy-protocol,omitempty"` // take client address from PROXY protocol headers
+	H2C           bool `yaml:"h2c,omitempty"`            // accept HTTP/2 without TLS, as well as HTTP/1.x
+
+	RedirectToHTTPS bool `yaml:"redirect-to-https,omitempty"` // redirect all requests to HTTPS
+	HTTPSPort       int  `yaml:"https-port,omitempty"`        // port to redirect to, if not 443
+
+	HealthPath    string `yaml:"health-path,omitempty"`    // overrides the global health path
+	ReadinessPath string `yaml:"readiness-path,omitempty"` // overrides the global readiness path
+
+	MaxRequestBody string `yaml:"max-request-body,omitempty"` // e.g. "10MB"; unlimited if unset
+	MaxHeaderBytes string `yaml:"max-header-bytes,omitempty"` // e.g. "64KB"; 1MB if unset
+	MaxConnections int    `yaml:"max-connections,omitempty"`  // requests handled at once; unlimited if unset
+	ServerHeader   string `yaml:"server-header,omitempty"`    // Server response header; unset if empty
+
+	AllowedHosts []string `yaml:"allowed-hosts,omitempty"` // Host headers accepted, e.g. "*.example.com"; any if unset
+
+	// Connection timeouts as durations (e.g. "30s"); "0" disables
+	ReadTimeout  string `yaml:"read-timeout,omitempty"`
+	WriteTimeout string `yaml:"write-timeout,omitempty"`
+	IdleTimeout  string `yaml:"idle-timeout,omitempty"`
+
+	RequestTimeout string `yaml:"request-timeout,omitempty"` // time allowed to handle each request
+	TimeoutMessage string `yaml:"timeout-message,omitempty"` // body of 503 responses to timed out requests
+
+	// TCP keep-alive probes on client connections; enabled by default
+	KeepAlive       *bool  `yaml:"keep-alive,omitempty"`
+	KeepAlivePeriod string `yaml:"keep-alive-period,omitempty"` // interval between probes
+
+	// Retries of failed binds, doubling the interval after each; none by default
+	BindRetries       int    `yaml:"bind-retries,omitempty"`
+	BindRetryInterval string `yaml:"bind-retry-interval,omitempty"` // before the first retry; defaults to 1s
+
+	readTimeout, writeTimeout, idleTimeout, requestTimeout time.Duration
+	keepAlivePeriod, bindRetryInterval                     time.Duration
+
+	accessLogger *AccessLogger     // nil if not logging
+	rateLimiter  *RateLimiter      // nil if not rate limiting
+	certs        *certificates     // nil if not HTTPS, or using ACME
+	clientCAs    *x509.CertPool    // nil unless verifying client certificates
+	acmeManager  *autocert.Manager // nil if not using ACME
 }
 
 func (l *Listener) sanitise() {
 	if l.Protocol == "" {
 		l.Protocol = "http"
 	}
-	if l.Addr == "" {
+	if l.AccessLog != nil {
+		l.AccessLog.sanitise()
+	}
+	for i, host := range l.AllowedHosts {
+		l.AllowedHosts[i] = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	if l.Addr == "" && len(l.Addrs) == 0 && l.Protocol != "unix" {
 		l.Addr = ":http"
 	}
+	if l.ReadTimeout == "" {
+		l.ReadTimeout = "60s"
+	}
+	if l.WriteTimeout == "" {
+		l.WriteTimeout = "60s"
+	}
+	if l.IdleTimeout == "" {
+		l.IdleTimeout = "120s"
+	}
+	l.readTimeout, _ = time.ParseDuration(l.ReadTimeout)
+	l.writeTimeout, _ = time.ParseDuration(l.WriteTimeout)
+	l.idleTimeout, _ = time.ParseDuration(l.IdleTimeout)
+	if l.RequestTimeout != "" {
+		l.requestTimeout, _ = time.ParseDuration(l.RequestTimeout)
+	}
+	if l.KeepAlivePeriod != "" {
+		l.keepAlivePeriod, _ = time.ParseDuration(l.KeepAlivePeriod)
+	}
+	if l.ClientCA != "" && l.ClientAuth == "" {
+		l.ClientAuth = "require"
+	}
+	if l.BindRetries > 0 && l.BindRetryInterval == "" {
+		l.BindRetryInterval = "1s"
+	}
+	l.bindRetryInterval, _ = time.ParseDuration(l.BindRetryInterval)
+}
+
+// addresses returns the addresses the listener will listen on. The address
+// defaults to ":http" for all but unix sockets.
+func (l Listener) addresses() []string {
+	var addrs []string
+	if l.Addr != "" {
+		addrs = append(addrs, l.Addr)
+	}
+	addrs = append(addrs, l.Addrs...)
+	if len(addrs) == 0 && l.Protocol != "unix" {
+		addrs = []string{":http"}
+	}
+	return addrs
 }
 
 func (l *Listener) check(label string) (ok bool) {
 	ok = true
-	if l.Protocol == "http" {
-		if l.CertFile != "" || l.KeyFile != "" {
+	if l.Protocol == "http" || l.Protocol == "unix" {
+		if l.CertFile != "" || l.KeyFile != "" || len(l.Certificates) > 0 || l.ACME != nil {
 			log.Printf(label + ": certificate supplied for non-HTTPS listener")
 			ok = false
 		}
-	} else if l.Protocol == "https" {
-		if _, err := os.Stat(l.CertFile); os.IsNotExist(err) {
-			log.Printf(label+": cert file `%s` does not exist", l.CertFile)
+		if l.Protocol == "unix" && len(l.addresses()) == 0 {
+			log.Printf(label + ": no socket path specified")
 			ok = false
 		}
-		if _, err := os.Stat(l.KeyFile); os.IsNotExist(err) {
-			log.Printf(label+": key file `%s` does not exist", l.KeyFile)
+	} else if l.Protocol == "https" {
+		if l.ACME != nil {
+			if len(l.certificatePairs()) > 0 {
+				log.Printf(label + ": certificate supplied for ACME listener")
+				ok = false
+			}
+			ok = l.ACME.check(label) && ok
+		} else if len(l.certificatePairs()) == 0 {
+			log.Printf(label + ": no certificate specified")
 			ok = false
+		} else {
+			for _, c := range l.certificatePairs() {
+				ok = c.check(label) && ok
+			}
 		}
 	} else {
 		log.Printf(label+": invalid protocol `%s`", l.Protocol)
 		ok = false
 	}
+	seen := make(map[string]bool)
+	for _, addr := range l.addresses() {
+		if seen[addr] {
+			log.Printf(label+": duplicate address `%s`", addr)
+			ok = false
+			continue
+		}
+		seen[addr] = true
+		if isFDAddr(addr) {
+			ok = checkFDAddr(label, addr) && ok
+		} else if l.Protocol == "unix" {
+			if !isWritableDir(filepath.Dir(addr)) {
+				log.Printf(label+": socket directory `%s` does not exist or is not writable", filepath.Dir(addr))
+				ok = false
+			}
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			log.Printf(label+": invalid address `%s`", addr)
+			ok = false
+		}
+	}
+	ok = l.checkTLS(label) && ok
+	if l.RedirectToHTTPS && l.Protocol != "http" {
+		log.Println(label + ": HTTPS redirect only supported on HTTP listeners")
+		ok = false
+	}
+	if l.HTTPSPort < 0 || l.HTTPSPort > 65535 {
+		log.Printf(label+": invalid HTTPS port %d", l.HTTPSPort)
+		ok = false
+	}
+	ok = l.GzipOptions.check(label) && ok
+	if l.AccessLog != nil {
+		ok = l.AccessLog.check(label) && ok
+	}
+	if l.RateLimit != nil {
+		ok = l.RateLimit.check(label) && ok
+	}
+	ok = checkHealthPath(label, "health path", l.HealthPath) && ok
+	ok = checkHealthPath(label, "readiness path", l.ReadinessPath) && ok
+	ok = checkSize(label, "max request body", l.MaxRequestBody) && ok
+	if n, err := parseSize(l.MaxHeaderBytes); l.MaxHeaderBytes != "" && (err != nil || n == 0 || n > math.MaxInt32) {
+		log.Printf(label+": invalid max header bytes `%s`", l.MaxHeaderBytes)
+		ok = false
+	}
+	for _, host := range l.AllowedHosts {
+		if !validHost(host) && net.ParseIP(host) == nil {
+			log.Printf(label+": invalid allowed host `%s`", host)
+			ok = false
+		}
+	}
+	if l.MaxConnections < 0 {
+		log.Printf(label+": invalid max connections %d", l.MaxConnections)
+		ok = false
+	}
+	ok = checkHeaders(label, l.Headers, l.ForceHeaders, l.RemoveHeaders) && ok
+	ok = checkDuration(label, "read timeout", l.ReadTimeout) && ok
+	ok = checkDuration(label, "write timeout", l.WriteTimeout) && ok
+	ok = checkDuration(label, "idle timeout", l.IdleTimeout) && ok
+	ok = checkDuration(label, "request timeout", l.RequestTimeout) && ok
+	ok = checkDuration(label, "keep-alive period", l.KeepAlivePeriod) && ok
+	ok = checkDuration(label, "bind retry interval", l.BindRetryInterval) && ok
+	if l.BindRetries < 0 {
+		log.Printf(label+": invalid bind retries %d", l.BindRetries)
+		ok = false
+	} else if l.BindRetries == 0 && l.BindRetryInterval != "" {
+		log.Println(label + ": bind retry interval specified without bind retries")
+		ok = false
+	}
+	if l.H2C && l.Protocol != "http" {
+		log.Println(label + ": h2c only supported on HTTP listeners")
+		ok = false
+	}
+	if l.ProxyProtocol && l.Protocol == "unix" {
+		log.Println(label + ": PROXY protocol only supported on TCP listeners")
+		ok = false
+	}
+	if l.KeepAlive != nil || l.KeepAlivePeriod != "" {
+		if l.Protocol == "unix" {
+			log.Println(label + ": keep-alive options supplied for Unix socket listener")
+			ok = false
+		} else if l.KeepAlive != nil && !*l.KeepAlive && l.KeepAlivePeriod != "" {
+			log.Println(label + ": keep-alive period supplied with keep-alive disabled")
+			ok = false
+		}
+	}
 	return
 }
 
+// server returns a new HTTP server for the listener serving h.
+func (l Listener) server(h http.Handler) *http.Server {
+	if l.H2C {
+		// HTTP/2 connections are taken over from the HTTP/1 server, so
+		// get their own idle timeout
+		h = h2c.NewHandler(h, &http2.Server{IdleTimeout: l.idleTimeout})
+	}
+	srv := &http.Server{
+		Addr:         l.Addr,
+		Handler:      h,
+		ReadTimeout:  l.readTimeout,
+		WriteTimeout: l.writeTimeout,
+		IdleTimeout:  l.idleTimeout,
+		TLSConfig:    l.tlsConfig(),
+	}
+	if l.MaxHeaderBytes != "" {
+		n, _ := parseSize(l.MaxHeaderBytes)
+		srv.MaxHeaderBytes = int(n)
+	}
+	if l.DisableHTTP2 {
+		// A non-nil map stops HTTP/2 being offered during TLS negotiation
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return srv
+}
+
+// listenRetrying listens on addr, retrying up to bind-retries times if it
+// fails. desc describes the address in logs.
+func (l Listener) listenRetrying(addr, desc string) (net.Listener, error) {
+	interval := l.bindRetryInterval
+	for retry := 1; ; retry++ {
+		ln, err := l.listen(addr)
+		if err == nil || retry > l.BindRetries {
+			return ln, err
+		}
+		log.Printf("Couldn't listen on %s: %s. Retrying in %s (%d of %d).\n", desc, err, interval, retry, l.BindRetries)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// listen listens on one of the listener's addresses, applying any keep-alive
+// options to the TCP connections it accepts, and reading their PROXY protocol
+// headers if enabled.
+func (l Listener) listen(addr string) (net.Listener, error) {
+	ln, err := l.listenAddr(addr)
+	if err != nil || l.Protocol == "unix" {
+		return ln, err
+	}
+	if l.KeepAlive != nil || l.keepAlivePeriod != 0 {
+		enabled := l.KeepAlive == nil || *l.KeepAlive
+		ln = keepAliveListener{ln, enabled, l.keepAlivePeriod}
+	}
+	if l.ProxyProtocol {
+		ln = proxyProtocolListener{ln}
+	}
+	return ln, nil
+}
+
+// listenAddr listens on addr, or takes over a socket passed by systemd for
+// "fd://" addresses. For Unix domain sockets, any stale socket left behind by
+// a previous process is removed first. The socket file is removed again when
+// the returned listener is closed.
+func (l Listener) listenAddr(addr string) (net.Listener, error) {
+	if isFDAddr(addr) {
+		return systemdListener(addr)
+	}
+	switch l.Protocol {
+	case "http", "https":
+		return net.Listen("tcp", addr)
+	case "unix":
+		if fi, err := os.Stat(addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(addr); err != nil {
+				return nil, err
+			}
+		}
+		return net.Listen("unix", addr)
+	}
+	return nil, fmt.Errorf("unsupported protocol %s", l.Protocol)
+}
+
+// keepAliveListener sets TCP keep-alive options on accepted connections,
+// overriding the defaults applied by the net package.
+type keepAliveListener struct {
+	net.Listener
+	enabled bool
+	period  time.Duration // system default if zero
+}
+
+func (ln keepAliveListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetKeepAlive(ln.enabled)
+		if ln.enabled && ln.period > 0 {
+			tc.SetKeepAlivePeriod(ln.period)
+		}
+	}
+	return c, nil
+}
+
+// isWritableDir returns true if dir is a directory that files can be
+// created in.
+func isWritableDir(dir string) bool {
+	f, err := ioutil.TempFile(dir, ".goserve")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
+
 // Serve represents a path that will be served.
 type Serve struct {
-	Target  string  `yaml:"target"`            // where files are stored on the file system
-	Path    string  `yaml:"path"`              // HTTP path to serve files under
-	Error   int     `yaml:"error,omitempty"`   // HTTP error to return (0=disabled)
-	Indexes bool    `yaml:"indexes,omitempty"` // list directory contents
-	Headers Headers `yaml:"headers,omitempty"` // custom headers
+	Target   string   `yaml:"target"`             // where files are stored on the file system
+	Targets  []string `yaml:"targets,omitempty"`  // further directories searched, in order, for files not in target
+	Mirrors  []Mirror `yaml:"mirrors,omitempty"`  // identical directories to spread reads across; target defaults to the first
+	Path     string   `yaml:"path"`               // HTTP path to serve files under
+	Host     string   `yaml:"host,omitempty"`     // serve only requests for this host, e.g. "*.example.com"
+	Internal bool     `yaml:"internal,omitempty"` // only serve files named by X-Goserve-Sendfile headers
+	Error    int      `yaml:"error,omitempty"`    // HTTP error to return (0=disabled)
+	Response string   `yaml:"response,omitempty"` // file containing a complete response to replay
+	Indexes  bool     `yaml:"indexes,omitempty"`  // list directory contents
+	Headers  Headers  `yaml:"headers,omitempty"`  // custom headers
+
+	Status    int  `yaml:"status,omitempty"`     // successful HTTP status to return, e.g. 204 (0=disabled)
+	EmptyBody bool `yaml:"empty-body,omitempty"` // respond to status without the status text as a body
+
+	ForceHeaders  Headers  `yaml:"force-headers,omitempty"`  // custom headers, replacing any existing values
+	RemoveHeaders []string `yaml:"remove-headers,omitempty"` // response headers to remove
+
+	ExtensionlessHTML  bool              `yaml:"extensionless-html,omitempty"`       // serve /x from /x.html
+	DefaultContentType string            `yaml:"default-content-type,omitempty"`     // instead of application/octet-stream
+	Stream             bool              `yaml:"stream,omitempty"`                   // stream without buffering or compression
+	Fallback           string            `yaml:"fallback,omitempty"`                 // file served for unknown paths (relative to target)
+	ETag               bool              `yaml:"etag,omitempty"`                     // set ETags based on file content
+	MIMETypes          map[string]string `yaml:"mime-types,omitempty"`               // overrides content types by extension
+	CacheControl       CacheControl      `yaml:"cache-control,omitempty"`            // Cache-Control by extension or pattern
+	IndexFiles         []string          `yaml:"index-files,omitempty"`              // directory index file names, in order of preference
+	ListingTemplate    string            `yaml:"listing-template,omitempty"`         // html/template file for directory listings
+	TrailingSlash      string            `yaml:"normalize-trailing-slash,omitempty"` // "add" or "strip" by redirecting
+	Precompressed      bool              `yaml:"precompressed,omitempty"`            // serve file.gz in place of file where accepted
+	StripPrefix        string            `yaml:"strip-prefix,omitempty"`             // removed from requests instead of path
+	AddPrefix          string            `yaml:"add-prefix,omitempty"`               // prepended to requests once stripped
+	DenyDotfiles       bool              `yaml:"deny-dotfiles,omitempty"`            // forbid paths with segments starting "."
+	Methods            []string          `yaml:"methods,omitempty"`                  // request methods allowed; defaults to GET and HEAD for files, or any
+	RequestTimeout     string            `yaml:"request-timeout,omitempty"`          // time allowed to handle each request
+	TimeoutMessage     string            `yaml:"timeout-message,omitempty"`          // body of 503 responses to timed out requests
+	DefaultCharset     string            `yaml:"default-charset,omitempty"`          // added to text types without a charset
+	CSPNonce           string            `yaml:"csp-nonce,omitempty"`                // Content-Security-Policy for HTML, with "{nonce}" replaced per response
+	ForceDownload      []string          `yaml:"force-download,omitempty"`           // extensions (or "*") served as attachments
+	Preload            []Preload         `yaml:"preload,omitempty"`                  // resources HTML pages should preload
+	DisableRanges      bool              `yaml:"disable-ranges,omitempty"`           // always serve whole files, ignoring Range headers
+	BufferResponses    string            `yaml:"buffer-responses,omitempty"`         // buffer responses up to this size, to send their Content-Length
+
+	ErrorPages map[int]string `yaml:"error-pages,omitempty"` // status to page (relative to target)
+
+	Auth *Auth `yaml:"auth,omitempty"` // credentials required to access
+	CORS *CORS `yaml:"cors,omitempty"` // cross-origin requests allowed
+
+	Sitemap *Sitemap `yaml:"sitemap,omitempty"` // sitemap.xml generated from the target's HTML files
+
+	Allow []string `yaml:"allow,omitempty"` // client networks allowed (CIDR)
+	Deny  []string `yaml:"deny,omitempty"`  // client networks denied (CIDR)
+
+	GzipOptions `yaml:",inline"` // overrides listener gzip options
+
+	errorHandlers map[int]http.Handler
+	bufferLimit   int64 // parsed from BufferResponses
+}
+
+// Mirror is one of several identical directories a serve's files are read
+// from, chosen at random in proportion to their weights.
+type Mirror struct {
+	Target string `yaml:"target"`
+	Weight int    `yaml:"weight,omitempty"` // defaults to 1
+}
+
+// Preload is a resource that browsers are told to fetch early, via a Link
+// header, when loading HTML pages.
+type Preload struct {
+	URL string `yaml:"url"`
+	As  string `yaml:"as"` // type of resource, e.g. "script" or "style"
+}
+
+// preloadTypes are the accepted values of a preload's `as`.
+var preloadTypes = []string{"audio", "document", "embed", "fetch", "font", "image", "object", "script", "style", "track", "video", "worker"}
+
+func (p Preload) check(label string) (ok bool) {
+	ok = true
+	if p.URL == "" || strings.ContainsAny(p.URL, "<> \t,;\"") {
+		log.Printf(label+": invalid preload URL `%s`", p.URL)
+		ok = false
+	}
+	for _, t := range preloadTypes {
+		if p.As == t {
+			return
+		}
+	}
+	log.Printf(label+": invalid preload type `%s` for `%s` (expected one of %s)", p.As, p.URL, strings.Join(preloadTypes, ", "))
+	return false
+}
+
+// link returns the value of the Link header preloading the resource. Fonts
+// are always fetched in CORS mode, so must be preloaded in the same way.
+func (p Preload) link() string {
+	link := "<" + p.URL + ">; rel=preload; as=" + p.As
+	if p.As == "font" {
+		link += "; crossorigin"
+	}
+	return link
 }
 
 func (s *Serve) sanitise() {
 	if s.Path == "" {
 		s.Path = "/"
 	}
+	for i := range s.Mirrors {
+		if s.Mirrors[i].Weight == 0 {
+			s.Mirrors[i].Weight = 1
+		}
+	}
+	if len(s.Mirrors) > 0 && s.Target == "" {
+		s.Target = s.Mirrors[0].Target
+	}
+	s.Host = strings.ToLower(s.Host)
+	// Only file serves default to GET and HEAD; others answer any method
+	if len(s.Methods) == 0 && s.Error == 0 && s.Status == 0 && s.Response == "" {
+		s.Methods = []string{"GET", "HEAD"}
+	}
+	for i, m := range s.Methods {
+		s.Methods[i] = strings.ToUpper(m)
+	}
+	if s.Auth != nil {
+		s.Auth.sanitise()
+	}
+	if s.CORS != nil {
+		s.CORS.sanitise()
+	}
+	if s.Sitemap != nil {
+		s.Sitemap.sanitise()
+	}
 }
 
 func (s Serve) check(label string) (ok bool) {
@@ -118,7 +916,7 @@ func (s Serve) check(label string) (ok bool) {
 		log.Println(label + ": no path specified")
 		ok = false
 	}
-	if s.Error == 0 && s.Target == "" {
+	if s.Error == 0 && s.Status == 0 && s.Target == "" && s.Response == "" {
 		log.Println(label + ": no target path specified")
 		ok = false
 	}
@@ -126,35 +924,484 @@ func (s Serve) check(label string) (ok bool) {
 		log.Println(label + ": error specified with target path")
 		ok = false
 	}
+	if s.Status != 0 {
+		if s.Status < 200 || s.Status > 299 {
+			log.Printf(label+": invalid status %d (use error for error statuses, or redirects for redirects)", s.Status)
+			ok = false
+		}
+		if s.Error != 0 || s.Target != "" || s.Response != "" {
+			log.Println(label + ": status specified with error, target path or response")
+			ok = false
+		}
+	}
+	if s.EmptyBody && s.Status == 0 {
+		log.Println(label + ": empty body specified without status")
+		ok = false
+	}
+	if s.Target != "" && TargetCheck {
+		if isZipTarget(s.Target) {
+			ok = checkZipTarget(label, s.Target) && ok
+		} else if fi, err := os.Stat(s.Target); err != nil {
+			log.Printf(label+": target %s does not exist", s.Target)
+			ok = false
+		} else if !fi.IsDir() && !fi.Mode().IsRegular() {
+			log.Printf(label+": target %s is not a directory or regular file", s.Target)
+			ok = false
+		}
+	}
+	if len(s.Targets) > 0 && (s.Target == "" || s.fileTarget()) {
+		log.Println(label + ": further targets require a directory target")
+		ok = false
+	}
+	if len(s.Mirrors) > 0 {
+		if s.Target != s.Mirrors[0].Target {
+			log.Println(label + ": target must be unset, or the first mirror, when mirrors are given")
+			ok = false
+		}
+		if len(s.Targets) > 0 {
+			log.Println(label + ": mirrors can't be used with further targets")
+			ok = false
+		}
+	}
+	for _, m := range s.Mirrors {
+		if m.Weight < 0 {
+			log.Printf(label+": invalid weight %d for mirror %s", m.Weight, m.Target)
+			ok = false
+		}
+		if isZipTarget(m.Target) {
+			ok = (!TargetCheck || checkZipTarget(label, m.Target)) && ok
+		} else if fi, err := os.Stat(m.Target); TargetCheck && err != nil {
+			log.Printf(label+": mirror %s does not exist", m.Target)
+			ok = false
+		} else if TargetCheck && !fi.IsDir() {
+			log.Printf(label+": mirror %s is not a directory", m.Target)
+			ok = false
+		}
+	}
+	for _, t := range s.Targets {
+		if isZipTarget(t) {
+			ok = (!TargetCheck || checkZipTarget(label, t)) && ok
+		} else if fi, err := os.Stat(t); TargetCheck && err != nil {
+			log.Printf(label+": target %s does not exist", t)
+			ok = false
+		} else if TargetCheck && !fi.IsDir() {
+			log.Printf(label+": target %s is not a directory", t)
+			ok = false
+		}
+	}
+	if s.TrailingSlash != "" {
+		if s.TrailingSlash != "add" && s.TrailingSlash != "strip" {
+			log.Printf(label+": invalid trailing slash normalization `%s`", s.TrailingSlash)
+			ok = false
+		}
+		if s.Target == "" || s.fileTarget() {
+			log.Println(label + ": trailing slash normalization requires a directory target")
+			ok = false
+		}
+	}
+	ok = checkDuration(label, "request timeout", s.RequestTimeout) && ok
+	ok = checkHeaders(label, s.Headers, s.ForceHeaders, s.RemoveHeaders) && ok
+	if s.Host != "" && !validHost(s.Host) {
+		log.Printf(label+": invalid host `%s`", s.Host)
+		ok = false
+	}
+	if s.Internal && s.Host != "" {
+		log.Println(label + ": internal serves can't have a host")
+		ok = false
+	}
+	if strings.ContainsAny(s.DefaultCharset, "; \t\"") {
+		log.Printf(label+": invalid default charset `%s`", s.DefaultCharset)
+		ok = false
+	}
+	if s.RequestTimeout != "" && s.Stream {
+		log.Println(label + ": request timeout can't be used with streaming, as responses are buffered")
+		ok = false
+	}
+	if s.BufferResponses != "" {
+		if n, err := parseSize(s.BufferResponses); err != nil || n == 0 {
+			log.Printf(label+": invalid buffer size `%s`", s.BufferResponses)
+			ok = false
+		}
+		if s.Stream {
+			log.Println(label + ": buffered responses can't be used with streaming")
+			ok = false
+		}
+	}
+	for _, p := range s.Preload {
+		ok = p.check(label) && ok
+	}
+	for _, ext := range s.ForceDownload {
+		if ext != "*" && (!strings.HasPrefix(ext, ".") || strings.ContainsAny(ext, "/*?[")) {
+			log.Printf(label+": invalid force download extension `%s` (expected e.g. `.pdf`, or `*`)", ext)
+			ok = false
+		}
+	}
+	if s.CSPNonce != "" {
+		if !strings.Contains(s.CSPNonce, cspNoncePlaceholder) {
+			log.Printf(label+": CSP nonce policy `%s` has no %s placeholder", s.CSPNonce, cspNoncePlaceholder)
+			ok = false
+		}
+		if s.Stream || s.Precompressed {
+			log.Println(label + ": CSP nonces can't be used with streaming or precompressed files, as HTML is rewritten")
+			ok = false
+		}
+	}
+	for _, m := range s.Methods {
+		if m == "" || strings.ContainsAny(m, " \t,") {
+			log.Printf(label+": invalid method `%s`", m)
+			ok = false
+		}
+	}
+	if s.StripPrefix != "" && !strings.HasPrefix(s.Path, s.StripPrefix) {
+		log.Printf(label+": strip prefix `%s` is not a prefix of path `%s`", s.StripPrefix, s.Path)
+		ok = false
+	}
+	for _, name := range s.IndexFiles {
+		if name == "" || strings.Contains(name, "/") {
+			log.Printf(label+": invalid index file name `%s`", name)
+			ok = false
+		}
+	}
+	if s.fileTarget() && (s.ListingTemplate != "" || s.Fallback != "" ||
+		s.ExtensionlessHTML || len(s.ErrorPages) > 0 || len(s.IndexFiles) > 0 || s.Precompressed) {
+		log.Println(label + ": listing template, fallback, extensionless HTML, error pages, index files and precompressed files require a directory target")
+		ok = false
+	}
+	if isZipTarget(s.Target) && (s.Fallback != "" || len(s.ErrorPages) > 0) {
+		log.Println(label + ": fallback and error pages can't be used with a zip target")
+		ok = false
+	}
+	if s.Response != "" {
+		if s.Error != 0 || s.Target != "" {
+			log.Println(label + ": response specified with error or target path")
+			ok = false
+		}
+		if _, err := ReadCannedResponse(s.Response); err != nil {
+			log.Printf(label+": invalid response file `%s`: %s", s.Response, err)
+			ok = false
+		}
+	}
+	if s.Fallback != "" && s.Target != "" && !isZipTarget(s.Target) {
+		if _, err := os.Stat(filepath.Join(s.Target, s.Fallback)); err != nil {
+			log.Printf(label+": fallback file `%s` does not exist", s.Fallback)
+			ok = false
+		}
+	}
+	if s.Auth != nil {
+		ok = s.Auth.check(label) && ok
+	}
+	if s.CORS != nil {
+		ok = s.CORS.check(label) && ok
+	}
+	if s.Sitemap != nil {
+		if s.Target == "" || s.fileTarget() {
+			log.Println(label + ": sitemap requires a directory target")
+			ok = false
+		}
+		if s.AddPrefix != "" {
+			log.Println(label + ": sitemap can't be used with add-prefix")
+			ok = false
+		}
+		ok = s.Sitemap.check(label) && ok
+	}
+	if s.ListingTemplate != "" {
+		if !s.Indexes || s.Target == "" {
+			log.Println(label + ": listing template specified without indexes or target path")
+			ok = false
+		}
+		if _, err := template.ParseFiles(s.ListingTemplate); err != nil {
+			log.Printf(label+": invalid listing template `%s`: %s", s.ListingTemplate, err)
+			ok = false
+		}
+	}
+	for status, page := range s.ErrorPages {
+		if status < 100 || status > 599 {
+			log.Printf(label+": invalid error page status %d", status)
+			ok = false
+		}
+		if s.Target == "" {
+			log.Println(label + ": error pages specified without target path")
+			ok = false
+		} else if isZipTarget(s.Target) {
+			continue
+		} else if _, err := os.Stat(filepath.Join(s.Target, page)); err != nil {
+			log.Printf(label+": error page `%s` does not exist", page)
+			ok = false
+		}
+	}
+	if _, err := parseCIDRs(s.Allow); err != nil {
+		log.Printf(label+": invalid allow list: %s", err)
+		ok = false
+	}
+	if _, err := parseCIDRs(s.Deny); err != nil {
+		log.Printf(label+": invalid deny list: %s", err)
+		ok = false
+	}
+	ok = checkMIMETypes(label, s.MIMETypes) && ok
+	ok = s.CacheControl.check(label) && ok
+	ok = s.GzipOptions.check(label) && ok
 	return
 }
 
-func (s Serve) handler() http.Handler {
+// fileTarget returns true if the serve's target is a single regular file
+// rather than a directory.
+func (s Serve) fileTarget() bool {
+	if s.Target == "" {
+		return false
+	}
+	fi, err := os.Stat(s.Target)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// errorHandler returns the serve's handler for the given status, if any.
+func (s *Serve) errorHandler(status int) http.Handler {
+	if s == nil {
+		return nil
+	}
+	return s.errorHandlers[status]
+}
+
+// gzipOptions returns the serve's gzip overrides, if any.
+func (s *Serve) gzipOptions() GzipOptions {
+	if s == nil {
+		return GzipOptions{}
+	}
+	return s.GzipOptions
+}
+
+// bufferSize returns the most of a response to buffer in order to send its
+// Content-Length, or 0 if responses aren't buffered.
+func (s *Serve) bufferSize() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.bufferLimit
+}
+
+// fileSystem returns the file system for a directory target, searching any
+// further targets in turn, or spreading reads across its mirrors.
+func (s Serve) fileSystem() (http.FileSystem, error) {
+	if len(s.Mirrors) > 0 {
+		var m MirrorDirs
+		for _, mirror := range s.Mirrors {
+			fs, err := targetFileSystem(mirror.Target)
+			if err != nil {
+				return nil, err
+			}
+			m.add(fs, mirror.Weight)
+		}
+		return &m, nil
+	}
+	dirs := MultiDir{}
+	for _, t := range append([]string{s.Target}, s.Targets...) {
+		fs, err := targetFileSystem(t)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, fs)
+	}
+	if len(dirs) == 1 {
+		return dirs[0], nil
+	}
+	return dirs, nil
+}
+
+// targetFileSystem returns the file system for a directory or zip target.
+func targetFileSystem(target string) (http.FileSystem, error) {
+	if !isZipTarget(target) {
+		return http.Dir(target), nil
+	}
+	fs, err := OpenZipFS(strings.TrimPrefix(target, zipTargetPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open zip target `%s`: %s", target, err)
+	}
+	return fs, nil
+}
+
+// handler returns the serve's handler, or an error if any of the files it
+// uses can't be loaded.
+func (s Serve) handler() (http.Handler, error) {
 	var h http.Handler
-	if s.Error > 0 {
-		errStatus := s.Error
-		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			http.Error(w, http.StatusText(errStatus), errStatus)
-		})
+	dir, err := s.fileSystem()
+	if err != nil {
+		return nil, err
+	}
+	fs := dir
+	if s.Response != "" {
+		resp, err := ReadCannedResponse(s.Response)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load response file `%s`: %s", s.Response, err)
+		}
+		h = resp
+	} else if s.Error > 0 {
+		h = StatusHandler(s.Error, true)
+	} else if s.Status > 0 {
+		h = StatusHandler(s.Status, !s.EmptyBody)
+	} else if s.fileTarget() {
+		fs = singleFileSystem(s.Target)
+		h = SingleFileHandler(s.Target)
 	} else if s.Indexes {
-		h = http.FileServer(http.Dir(s.Target))
+		h = http.FileServer(dir)
+		if s.ListingTemplate != "" {
+			tmpl, err := template.ParseFiles(s.ListingTemplate)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't load listing template `%s`: %s", s.ListingTemplate, err)
+			}
+			h = ListingTemplateHandler(h, dir, tmpl)
+		}
+		h = ListingJSONHandler(h, dir)
 	} else {
 		// Prevent listing of directories lacking an index.html file
-		h = SuppressListingHandler(http.Dir(s.Target))
+		h = SuppressListingHandler(dir)
+	}
+
+	if s.Target != "" {
+		if s.Stream {
+			h = StreamHandler(h)
+		}
+		if s.ETag {
+			h = ETagHandler(h, fs)
+		}
+		if s.Precompressed {
+			h = PrecompressedHandler(h, dir)
+		}
+		if s.DefaultContentType != "" {
+			h = DefaultContentTypeHandler(h, s.DefaultContentType)
+		}
+		if len(s.MIMETypes) > 0 {
+			h = MIMETypesHandler(h, s.MIMETypes)
+		}
+		if s.DefaultCharset != "" {
+			h = DefaultCharsetHandler(h, s.DefaultCharset)
+		}
+		if len(s.CacheControl) > 0 {
+			h = CacheControlHandler(h, s.CacheControl)
+		}
+		if len(s.ForceDownload) > 0 {
+			h = ForceDownloadHandler(h, s.ForceDownload)
+		}
+		if len(s.Preload) > 0 {
+			links := make([]string, len(s.Preload))
+			for i, p := range s.Preload {
+				links[i] = p.link()
+			}
+			h = PreloadHandler(h, links)
+		}
+		if s.Fallback != "" {
+			h = FallbackHandler(h, dir, s.Fallback)
+		}
+		if len(s.IndexFiles) > 0 {
+			h = IndexFilesHandler(h, dir, s.IndexFiles)
+		}
+		if s.TrailingSlash != "" {
+			h = TrailingSlashHandler(h, dir, s.TrailingSlash)
+		}
+		if s.ExtensionlessHTML {
+			h = ExtensionlessHTMLHandler(h, dir)
+		}
+		if s.Sitemap != nil {
+			// Files are found at the URL path that's stripped from requests
+			prefix := s.Path
+			if s.StripPrefix != "" {
+				prefix = s.StripPrefix
+			}
+			h = SitemapHandler(h, dir, s.Sitemap.Path, s.Sitemap.BaseURL, prefix, s.ExtensionlessHTML)
+		}
 	}
 
+	if s.DisableRanges {
+		h = DisableRangesHandler(h)
+	}
+	if s.CSPNonce != "" {
+		h = CSPNonceHandler(h, s.CSPNonce)
+	}
+	bufferLimit, _ := parseSize(s.BufferResponses)
+	if bufferLimit > 0 {
+		h = BufferHandler(h, bufferLimit)
+	}
+
+	// Only the serve's own work is timed, not that of the wrappers below
+	if s.RequestTimeout != "" {
+		if d, _ := time.ParseDuration(s.RequestTimeout); d > 0 {
+			h = http.TimeoutHandler(h, d, s.TimeoutMessage)
+		}
+	}
+
+	if s.DenyDotfiles {
+		h = DenyDotfilesHandler(h)
+	}
+	if len(s.Methods) > 0 {
+		h = MethodsHandler(h, s.Methods)
+	}
+
+	if len(s.RemoveHeaders) > 0 {
+		h = RemoveHeadersHandler(h, s.RemoveHeaders)
+	}
 	if len(s.Headers) > 0 {
 		h = CustomHeadersHandler(h, s.Headers)
 	}
+	if len(s.ForceHeaders) > 0 {
+		h = ForceHeadersHandler(h, s.ForceHeaders)
+	}
+
+	if s.Auth != nil {
+		valid, err := s.Auth.credentials()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't load credentials: %s", err)
+		}
+		h = BasicAuthHandler(h, s.Auth.Realm, valid)
+	}
+
+	// Preflight requests don't carry credentials, so must be handled first
+	if s.CORS != nil {
+		h = CORSHandler(h, *s.CORS)
+	}
 
-	return http.StripPrefix(s.Path, h)
+	if len(s.Allow) > 0 || len(s.Deny) > 0 {
+		allow, _ := parseCIDRs(s.Allow)
+		deny, _ := parseCIDRs(s.Deny)
+		h = IPFilterHandler(h, allow, deny)
+	}
+
+	// By default the serve's path is stripped, so that it corresponds to the
+	// target. strip-prefix replaces it, and add-prefix is then prepended.
+	if s.AddPrefix != "" {
+		h = AddPrefixHandler(h, s.AddPrefix)
+	}
+	strip := s.Path
+	if s.StripPrefix != "" {
+		strip = s.StripPrefix
+	}
+	h = http.StripPrefix(strip, h)
+
+	// Record the matched serve for the benefit of outer handlers, including
+	// the mux, which uses it to find the serve's error pages
+	serve := &s
+	serve.bufferLimit = bufferLimit
+	serve.errorHandlers = make(map[int]http.Handler)
+	for status, page := range s.ErrorPages {
+		e := Error{Status: status, Target: filepath.Join(s.Target, page)}
+		serve.errorHandlers[status] = e.handler()
+	}
+	// Error responses are otherwise replaced by the mux, so the timeout
+	// message is served as the serve's own 503 page unless it has one
+	if s.TimeoutMessage != "" && serve.errorHandlers[http.StatusServiceUnavailable] == nil {
+		serve.errorHandlers[http.StatusServiceUnavailable] = MessageHandler(http.StatusServiceUnavailable, s.TimeoutMessage)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		GetRequestInfo(r).Serve = serve
+		h.ServeHTTP(w, r)
+	}), nil
 }
 
 // Redirect represents a redirect from one path to another.
 type Redirect struct {
-	From string `yaml:"from"`
-	To   string `yaml:"to"`
-	With int    `yaml:"status,omitempty"`
+	From  string `yaml:"from"`
+	To    string `yaml:"to"`
+	With  int    `yaml:"status,omitempty"`
+	Regex bool   `yaml:"regex,omitempty"` // `from` is a regular expression
+
+	PreserveQuery bool `yaml:"preserve-query,omitempty"` // append request query to `to`
 }
 
 func (r *Redirect) sanitise() {
@@ -165,6 +1412,7 @@ func (r *Redirect) sanitise() {
 }
 
 func (r Redirect) check(label string) (ok bool) {
+	ok = true
 	if r.From == "" {
 		log.Printf(label + ": no `from` path")
 		ok = false
@@ -175,31 +1423,110 @@ func (r Redirect) check(label string) (ok bool) {
 		ok = false
 	}
 
-	return true
+	switch r.With {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		log.Printf(label+": invalid status %d (must be one of 301, 302, 303, 307 or 308)", r.With)
+		ok = false
+	}
+
+	if r.Regex {
+		if _, err := regexp.Compile(r.From); err != nil {
+			log.Printf(label+": invalid `from` pattern: %s", err)
+			ok = false
+		}
+	}
+
+	return
 }
 
 func (r Redirect) handler() http.Handler {
+	if r.Regex {
+		return PatternRedirectHandler(regexp.MustCompile(r.From), r.To, r.With, r.PreserveQuery)
+	}
+	if r.PreserveQuery {
+		return QueryRedirectHandler(r.To, r.With)
+	}
 	return http.RedirectHandler(r.To, r.With)
 }
 
-// Error represents what to do when a particular HTTP status is encountered.
+// Error represents what to do when a particular HTTP status is encountered:
+// either serve a page with that status, or redirect elsewhere.
 type Error struct {
-	Status int    `yaml:"status"`
-	Target string `yaml:"target"`
+	Status   int            `yaml:"status"`
+	Target   string         `yaml:"target,omitempty"`   // page to serve
+	Redirect *ErrorRedirect `yaml:"redirect,omitempty"` // redirect instead of serving a page
+}
+
+// ErrorRedirect redirects requests that result in an error, e.g. to a search
+// page when a file isn't found.
+type ErrorRedirect struct {
+	To     string `yaml:"to"`
+	Status int    `yaml:"status,omitempty"`
 }
 
 func (e *Error) sanitise() {
+	if e.Redirect != nil && e.Redirect.Status == 0 {
+		e.Redirect.Status = http.StatusFound
+		log.Printf("Defaulting status code %d for error %d redirect\n", e.Redirect.Status, e.Status)
+	}
 }
 
-func (e Error) check() (ok bool) {
-	return true
+func (e Error) check(label string) (ok bool) {
+	ok = true
+	if e.Status < 100 || e.Status > 599 {
+		log.Printf(label+": invalid error status %d", e.Status)
+		ok = false
+	}
+	if (e.Target == "") == (e.Redirect == nil) {
+		log.Println(label + ": exactly one of target and redirect must be specified")
+		ok = false
+	}
+	if e.Redirect != nil {
+		if e.Redirect.To == "" {
+			log.Println(label + ": no redirect `to` URL")
+			ok = false
+		}
+		switch e.Redirect.Status {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+			http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		default:
+			log.Printf(label+": invalid redirect status %d (must be one of 301, 302, 303, 307 or 308)", e.Redirect.Status)
+			ok = false
+		}
+	}
+	return
 }
 
 func (e Error) handler() http.Handler {
+	if e.Redirect != nil {
+		redirect := *e.Redirect
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Send the redirect's own status, not the error's
+			if sw, ok := w.(statusResponseWriter); ok {
+				w = sw.ResponseWriter
+			}
+			// Clear content-type as set by `http.Error`, so the redirect's
+			// own body is sent
+			w.Header().Del("Content-Type")
+			http.Redirect(w, r, redirect.To, redirect.Status)
+		})
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Clear content-type as set by `http.Error` to force re-detection
 		w.Header().Del("Content-Type")
 
+		// Ranges of the page would be served with the error status, so
+		// always serve it whole. Conditional requests are still honoured.
+		if r.Header.Get("Range") != "" {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.Header = r.Header.Clone()
+			r2.Header.Del("Range")
+			r = r2
+		}
+
 		// Serve error page with a specific status code
 		http.ServeFile(w, r, e.Target)
 	})
@@ -0,0 +1,160 @@
+package goserve
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRedirectPreservesMethod(t *testing.T) {
+	h := testHandler(t, ServerConfig{
+		Serves:    []Serve{{Path: "/x", Status: http.StatusNoContent}},
+		Redirects: []Redirect{{From: "/old", To: "/new", With: http.StatusPermanentRedirect}},
+	})
+	var method, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/new" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		method, body = r.Method, string(b)
+	}))
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/old", "text/plain", strings.NewReader("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if method != "POST" || body != "data" {
+		t.Errorf("redirected request was %s with body %q", method, body)
+	}
+}
+
+func TestRedirectCheck(t *testing.T) {
+	for _, c := range []struct {
+		r  Redirect
+		ok bool
+	}{
+		{Redirect{To: "/new"}, false},
+		{Redirect{From: "/old"}, false},
+		{Redirect{From: "/old", To: "/new"}, true},
+		{Redirect{From: "/old", To: "/new", With: http.StatusPermanentRedirect}, true},
+		{Redirect{From: "/old", To: "/new", With: http.StatusOK}, false},
+		{Redirect{From: "(", To: "/new", Regex: true}, false},
+	} {
+		c.r.sanitise()
+		if ok := c.r.check("Redirect"); ok != c.ok {
+			t.Errorf("%+v: check returned %t", c.r, ok)
+		}
+	}
+}
+
+func TestServeStatusCheck(t *testing.T) {
+	for _, c := range []struct {
+		s  Serve
+		ok bool
+	}{
+		{Serve{Path: "/x", Status: http.StatusNoContent}, true},
+		{Serve{Path: "/x", Status: http.StatusOK, EmptyBody: true}, true},
+		{Serve{Path: "/x", Status: http.StatusFound}, false},
+		{Serve{Path: "/x", Status: http.StatusNotModified}, false},
+		{Serve{Path: "/x", Status: http.StatusNotFound}, false},
+		{Serve{Path: "/x", EmptyBody: true, Error: http.StatusNotFound}, false},
+	} {
+		c.s.sanitise()
+		if ok := c.s.check("Serve"); ok != c.ok {
+			t.Errorf("%+v: check returned %t", c.s, ok)
+		}
+	}
+}
+
+func TestServeStatusMethods(t *testing.T) {
+	h := testHandler(t, ServerConfig{
+		Serves: []Serve{
+			{Path: "/any", Status: http.StatusNoContent},
+			{Path: "/get", Status: http.StatusNoContent, Methods: []string{"GET"}},
+		},
+	})
+	for _, c := range []struct {
+		method, target string
+		code           int
+	}{
+		{"GET", "/any", http.StatusNoContent},
+		{"POST", "/any", http.StatusNoContent},
+		{"DELETE", "/any", http.StatusNoContent},
+		{"GET", "/get", http.StatusNoContent},
+		{"POST", "/get", http.StatusMethodNotAllowed},
+	} {
+		if w := get(h, c.method, c.target); w.Code != c.code {
+			t.Errorf("%s %s: got %d, want %d", c.method, c.target, w.Code, c.code)
+		}
+	}
+}
+
+func TestCheckMIMETypes(t *testing.T) {
+	for _, c := range []struct {
+		types map[string]string
+		ok    bool
+	}{
+		{map[string]string{".wasm": "application/wasm"}, true},
+		{map[string]string{"wasm": "application/wasm"}, false},
+		{map[string]string{".x": "not a type"}, false},
+	} {
+		if ok := checkMIMETypes("Config", c.types); ok != c.ok {
+			t.Errorf("%v: check returned %t", c.types, ok)
+		}
+	}
+}
+
+func TestSanitiseInPlace(t *testing.T) {
+	cfg := ServerConfig{
+		Listeners: []Listener{{}, {Protocol: "unix", Addr: "/tmp/goserve.sock"}},
+		Serves:    []Serve{{Path: "/", Target: "."}},
+		Redirects: []Redirect{{From: "/old", To: "/new"}},
+	}
+	cfg.Sanitise()
+	if l := cfg.Listeners[0]; l.Protocol != "http" || l.Addr != ":http" {
+		t.Errorf("got listener %s %q", l.Protocol, l.Addr)
+	}
+	if l := cfg.Listeners[1]; l.Addr != "/tmp/goserve.sock" {
+		t.Errorf("got unix listener %q", l.Addr)
+	}
+	if m := cfg.Serves[0].Methods; len(m) != 2 || m[0] != "GET" || m[1] != "HEAD" {
+		t.Errorf("got serve methods %v", m)
+	}
+	if w := cfg.Redirects[0].With; w != http.StatusMovedPermanently {
+		t.Errorf("got redirect status %d", w)
+	}
+}
+
+func TestErrorPageConditional(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"404.html": "<h1>Not found</h1>"})
+	h := testHandler(t, ServerConfig{
+		Serves: []Serve{{Path: "/gone", Error: http.StatusNotFound}},
+		Errors: []Error{{Status: http.StatusNotFound, Target: filepath.Join(dir, "404.html")}},
+	})
+	w := get(h, "GET", "/gone")
+	if w.Code != http.StatusNotFound || w.Body.String() != "<h1>Not found</h1>" {
+		t.Fatalf("got %d %q", w.Code, w.Body.String())
+	}
+	modified := w.Header().Get("Last-Modified")
+	if modified == "" {
+		t.Fatal("no Last-Modified")
+	}
+	// Revalidating is answered the same way every time
+	for i := 0; i < 2; i++ {
+		w = get(h, "GET", "/gone", "If-Modified-Since", modified)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("request %d: got %d %q", i, w.Code, w.Body.String())
+		}
+	}
+	w = get(h, "GET", "/gone", "Range", "bytes=0-3")
+	if w.Code != http.StatusNotFound || w.Body.String() != "<h1>Not found</h1>" {
+		t.Errorf("range: got %d %q", w.Code, w.Body.String())
+	}
+}
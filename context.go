@@ -0,0 +1,130 @@
+package goserve
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RequestInfo holds request-scoped values shared by the handler chain.
+//
+// A single RequestInfo is attached to each request's context as soon as it
+// is accepted by a listener. Because it is a pointer, values filled in by
+// inner handlers (such as the matched Serve) are also visible to outer
+// middleware (such as loggers) once the inner handler has run.
+type RequestInfo struct {
+	Listener *Listener // listener that accepted the request
+	Serve    *Serve    // serve matched by the mux, nil if none
+	ClientIP net.IP    // resolved client address
+	ID       string    // request ID, empty if not assigned
+	Verbatim bool      // response is sent as is, rather than replaced by an error page
+}
+
+type contextKey int
+
+// requestInfoKey is the context key under which the *RequestInfo is stored.
+const requestInfoKey contextKey = 0
+
+// GetRequestInfo returns the RequestInfo associated with the request. It
+// never returns nil; requests that did not pass through RequestInfoHandler
+// get an empty RequestInfo.
+func GetRequestInfo(r *http.Request) *RequestInfo {
+	if info, ok := r.Context().Value(requestInfoKey).(*RequestInfo); ok {
+		return info
+	}
+	return &RequestInfo{}
+}
+
+// ensureRequestInfo returns r, or a copy of it with an empty RequestInfo
+// attached if it has none.
+func ensureRequestInfo(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(requestInfoKey).(*RequestInfo); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey, &RequestInfo{}))
+}
+
+// RequestInfoHandler attaches a new RequestInfo, populated with the listener
+// and the client's address, to each request before passing it on.
+func RequestInfoHandler(h http.Handler, l *Listener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if l.TrustProxy {
+			if fwd := forwardedIP(r); fwd != nil {
+				ip = fwd
+			}
+		}
+		info := &RequestInfo{
+			Listener: l,
+			ClientIP: ip,
+		}
+		ctx := context.WithValue(r.Context(), requestInfoKey, info)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// maxRequestIDLength is the longest request ID accepted from clients.
+const maxRequestIDLength = 200
+
+// RequestIDHandler gives each request an ID, taken from the header of the
+// given name if the client (or a proxy in front of goserve) sent a valid one,
+// or otherwise generated at random. The ID is recorded in the request's
+// RequestInfo, for logging, and set in the same header of the response.
+func RequestIDHandler(h http.Handler, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		GetRequestInfo(r).ID = id
+		w.Header().Set(header, id)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID returns true if id is non-empty, not too long, and made of
+// characters safe to include in logs and headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune("-_.:/+=", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns 16 random bytes, hex-encoded.
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// remoteIP returns the IP address of the connection's remote end.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedIP returns the last valid address in the request's
+// X-Forwarded-For header, which is that of the client as seen by the proxy
+// in front of goserve. Earlier addresses are ignored as they may be forged.
+func forwardedIP(r *http.Request) net.IP {
+	addrs := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(addrs) - 1; i >= 0; i-- {
+		if ip := net.ParseIP(strings.TrimSpace(addrs[i])); ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
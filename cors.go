@@ -0,0 +1,95 @@
+package goserve
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORS describes the cross-origin requests permitted to a serve.
+type CORS struct {
+	AllowOrigins []string `yaml:"allow-origins"`           // origins, or "*" for any
+	AllowMethods []string `yaml:"allow-methods,omitempty"` // defaults to GET and HEAD
+	AllowHeaders []string `yaml:"allow-headers,omitempty"`
+	MaxAge       int      `yaml:"max-age,omitempty"` // seconds preflight responses may be cached
+}
+
+func (c *CORS) sanitise() {
+	if len(c.AllowMethods) == 0 {
+		c.AllowMethods = []string{"GET", "HEAD"}
+	}
+}
+
+func (c CORS) check(label string) (ok bool) {
+	ok = true
+	if len(c.AllowOrigins) == 0 {
+		log.Println(label + ": no CORS origins allowed")
+		ok = false
+	}
+	if c.MaxAge < 0 {
+		log.Printf(label+": negative CORS max age %d", c.MaxAge)
+		ok = false
+	}
+	return
+}
+
+// wildcard returns true if any origin is allowed.
+func (c CORS) wildcard() bool {
+	for _, o := range c.AllowOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true if the given origin is allowed.
+func (c CORS) allows(origin string) bool {
+	for _, o := range c.AllowOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// CORSHandler adds CORS headers to responses to allowed origins, and responds
+// to preflight requests without passing them on to h.
+func CORSHandler(h http.Handler, c CORS) http.Handler {
+	wildcard := c.wildcard()
+	methods := strings.Join(c.AllowMethods, ", ")
+	headers := strings.Join(c.AllowHeaders, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wh := w.Header()
+		if !wildcard {
+			addVary(wh, "Origin")
+		}
+
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && c.allows(origin)
+		if allowed {
+			if wildcard {
+				wh.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				wh.Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				wh.Set("Access-Control-Allow-Methods", methods)
+				if headers != "" {
+					wh.Set("Access-Control-Allow-Headers", headers)
+				}
+				if c.MaxAge > 0 {
+					wh.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
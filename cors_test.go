@@ -0,0 +1,35 @@
+package goserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORSVary(t *testing.T) {
+	c := CORS{AllowOrigins: []string{"https://example.com"}}
+	c.sanitise()
+	h := CORSHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), c)
+
+	// Origin is added once, even if the listener's custom headers already
+	// vary by it
+	for _, c := range []struct {
+		vary, want string
+	}{
+		{"Accept-Encoding", "Accept-Encoding|Origin"},
+		{"Origin", "Origin"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Origin", "https://example.com")
+		w := httptest.NewRecorder()
+		w.Header().Set("Vary", c.vary)
+		h.ServeHTTP(w, r)
+		if got := strings.Join(w.Header()["Vary"], "|"); got != c.want {
+			t.Errorf("given Vary %q, got %q", c.vary, got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://example.com" {
+			t.Errorf("got Access-Control-Allow-Origin %q", got)
+		}
+	}
+}
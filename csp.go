@@ -0,0 +1,154 @@
+package goserve
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cspNoncePlaceholder is replaced by each response's nonce in a `csp-nonce`
+// policy.
+const cspNoncePlaceholder = "{nonce}"
+
+// cspTagPattern matches the opening tags of script and style elements.
+var cspTagPattern = regexp.MustCompile(`(?i)<(script|style)\b[^>]*>`)
+
+// nonceAttrPattern matches a nonce attribute within a tag.
+var nonceAttrPattern = regexp.MustCompile(`(?i)\snonce\s*=`)
+
+// newCSPNonce returns a random, base64-encoded nonce.
+func newCSPNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// addCSPNonce adds a nonce attribute to each script and style tag in html
+// that doesn't already have one. Tags are found by matching text, not by
+// parsing, so e.g. tags within comments are changed too, harmlessly.
+func addCSPNonce(html []byte, nonce string) []byte {
+	attr := []byte(` nonce="` + nonce + `"`)
+	return cspTagPattern.ReplaceAllFunc(html, func(tag []byte) []byte {
+		if nonceAttrPattern.Match(tag) {
+			return tag
+		}
+		// Insert the attribute after the tag name
+		i := 1
+		for i < len(tag) && (tag[i]|0x20 >= 'a' && tag[i]|0x20 <= 'z') {
+			i++
+		}
+		out := make([]byte, 0, len(tag)+len(attr))
+		out = append(out, tag[:i]...)
+		out = append(out, attr...)
+		return append(out, tag[i:]...)
+	})
+}
+
+// mayBeHTML returns true if the file at p might be served as HTML, going by
+// its extension.
+func mayBeHTML(p string) bool {
+	ext := strings.ToLower(path.Ext(p))
+	return ext == "" || ext == ".html" || ext == ".htm"
+}
+
+// cspResponseWriter buffers successful HTML responses so that nonces can be
+// added to them. Other responses are passed through.
+type cspResponseWriter struct {
+	http.ResponseWriter
+	policy      string
+	nonce       string
+	head        bool          // responding to a HEAD request
+	buf         *bytes.Buffer // nil unless buffering an HTML response
+	wroteHeader bool
+}
+
+func (w *cspResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if status == http.StatusOK && mediaType == "text/html" {
+		w.buf = new(bytes.Buffer)
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *cspResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		detectContentType(w.Header(), b)
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf != nil {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish writes out a buffered HTML response, with nonces added to it and its
+// policy, and without validators or range support, as its content differs
+// every time.
+func (w *cspResponseWriter) finish() {
+	if w.buf == nil {
+		return
+	}
+	body := addCSPNonce(w.buf.Bytes(), w.nonce)
+	wh := w.Header()
+	wh.Set("Content-Security-Policy", strings.Replace(w.policy, cspNoncePlaceholder, w.nonce, -1))
+	wh.Del("ETag")
+	wh.Del("Last-Modified")
+	wh.Del("Accept-Ranges")
+	if w.head {
+		wh.Del("Content-Length")
+	} else {
+		wh.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+	if !w.head {
+		w.ResponseWriter.Write(body)
+	}
+}
+
+// CSPNonceHandler sets a Content-Security-Policy header on successful HTML
+// responses, given by policy with each "{nonce}" replaced by a nonce
+// generated for the response, and adds the nonce to the response's script
+// and style tags. HTML responses are buffered in full to do so. As they
+// differ every time, conditional and range requests for files that may be
+// HTML are served in full.
+func CSPNonceHandler(h http.Handler, policy string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce, err := newCSPNonce()
+		if err != nil {
+			log.Printf("Couldn't generate nonce for %s: %s\n", r.URL.Path, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if mayBeHTML(r.URL.Path) {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.Header = r.Header.Clone()
+			for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+				r2.Header.Del(name)
+			}
+			r = r2
+		}
+		cw := &cspResponseWriter{
+			ResponseWriter: w,
+			policy:         policy,
+			nonce:          nonce,
+			head:           r.Method == "HEAD",
+		}
+		h.ServeHTTP(cw, r)
+		cw.finish()
+	})
+}
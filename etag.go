@@ -0,0 +1,84 @@
+package goserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+// etagEntry is a cached ETag, valid while the file's size and modification
+// time are unchanged.
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// ETagCache computes and caches content-based ETags for files.
+type ETagCache struct {
+	fs      http.FileSystem
+	mu      sync.RWMutex
+	entries map[string]etagEntry
+}
+
+// NewETagCache allocates and returns a new ETagCache for files in fs.
+func NewETagCache(fs http.FileSystem) *ETagCache {
+	return &ETagCache{
+		fs:      fs,
+		entries: make(map[string]etagEntry),
+	}
+}
+
+// ETag returns the strong ETag of the named file, or of the index.html file
+// if name is a directory. An empty string is returned if there's no such file.
+func (c *ETagCache) ETag(name string) string {
+	f, err := c.fs.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	if fi.IsDir() {
+		return c.ETag(path.Join(name, "index.html"))
+	}
+
+	c.mu.RLock()
+	e, ok := c.entries[name]
+	c.mu.RUnlock()
+	if ok && e.size == fi.Size() && e.modTime.Equal(fi.ModTime()) {
+		return e.etag
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	e = etagEntry{
+		size:    fi.Size(),
+		modTime: fi.ModTime(),
+		etag:    `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`,
+	}
+	c.mu.Lock()
+	c.entries[name] = e
+	c.mu.Unlock()
+	return e.etag
+}
+
+// ETagHandler sets a content-based ETag on responses for files in fs. The
+// wrapped file server then honours `If-None-Match` using this ETag.
+func ETagHandler(h http.Handler, fs http.FileSystem) http.Handler {
+	cache := NewETagCache(fs)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if etag := cache.ETag(r.URL.Path); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -1,160 +1,525 @@
-package main
+// Package goserve implements a configurable static file server. The goserve
+// command is a thin wrapper around it, and other programs can embed it in the
+// same way:
+//
+//	cfg, err := goserve.ReadServerConfig("goserve.yaml")
+//	if err != nil {
+//		log.Fatalln(err)
+//	}
+//	srv, err := goserve.NewServer(cfg)
+//	if err != nil {
+//		log.Fatalln(err)
+//	}
+//	if err := srv.Start(); err != nil {
+//		log.Fatalln(err)
+//	}
+//	select {
+//	case err := <-srv.Errors():
+//		log.Fatalln(err)
+//	case <-done:
+//	}
+//	srv.Shutdown(ctx)
+package goserve
 
 import (
-	"gopkg.in/v1/yaml"
+	"golang.org/x/crypto/acme/autocert"
 
-	"flag"
-	"io/ioutil"
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var cfg ServerConfig
+// ReadServerConfig reads a config file, along with any files it includes.
+func ReadServerConfig(filename string) (cfg ServerConfig, err error) {
+	return readConfigFile(filename, nil)
+}
 
-func init() {
-	configPath := flag.String("config", "", "Path to configuration")
-	checkConfig := flag.Bool("config.check", false, "Check config then quit")
-	echoConfig := flag.Bool("config.echo", false, "Echo config then quit")
+// expandEnv replaces `${VAR}` and `$VAR` in data with the values of the
+// corresponding environment variables, or nothing if unset. `$$` is replaced
+// with a literal `$`.
+func expandEnv(data []byte) []byte {
+	return []byte(os.Expand(string(data), func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		return os.Getenv(name)
+	}))
+}
 
-	indexes := flag.Bool("indexes", true, "Allow directory listing")
+// LogSummary logs a concise description of the effective configuration.
+func LogSummary(cfg ServerConfig) {
+	log.Printf("goserve: %d listener(s), %d serve(s), %d redirect(s), %d error handler(s)\n",
+		len(cfg.Listeners), len(cfg.Serves), len(cfg.Redirects), len(cfg.Errors))
+	for i, l := range cfg.Listeners {
+		tls := "no TLS"
+		if l.ACME != nil {
+			tls = "ACME certs for " + strings.Join(l.ACME.Domains, ", ")
+		} else if l.Protocol == "https" {
+			var certs []string
+			for _, c := range l.certificatePairs() {
+				certs = append(certs, c.CertFile)
+			}
+			tls = "TLS cert " + strings.Join(certs, ", ")
+		}
+		log.Printf("  listener #%d: %s %s, %s, gzip %t, brotli %t, %d custom header(s)\n",
+			i, l.Protocol, strings.Join(l.addresses(), ", "), tls, l.Gzip, l.Brotli, len(l.Headers))
+	}
+	log.Printf("  middleware: %s\n", strings.Join(middlewareOrder(cfg.MiddlewareOrder), ", "))
+}
 
-	httpEnabled := flag.Bool("http", true, "Enable HTTP listener")
-	httpAddr := flag.String("http.addr", ":8080", "HTTP address")
-	httpGzip := flag.Bool("http.gzip", true, "Enable HTTP gzip compression")
+// buildMux returns a mux serving the config's serves, errors and redirects,
+// or an error if any of the serves' handlers can't be built, or their routes
+// conflict.
+func buildMux(cfg ServerConfig) (mux *StaticServeMux, err error) {
+	// Conflicting routes make the mux panic, which would otherwise take down
+	// a running server on reload, or the program embedding it
+	defer func() {
+		if p := recover(); p != nil {
+			mux, err = nil, fmt.Errorf("couldn't register routes: %v", p)
+		}
+	}()
+	mux = NewStaticServeMux()
+	for _, e := range cfg.Errors {
+		mux.HandleError(e.Status, e.handler())
+	}
+	registered := make(map[string]bool)
+	for i, serve := range cfg.Serves {
+		h, err := serve.handler()
+		if err != nil {
+			return nil, fmt.Errorf("serve #%d: %s", i, err)
+		}
+		if serve.Internal {
+			mux.HandleInternal(serve.Path, h)
+			continue
+		}
+		mux.HandleHost(serve.Host, serve.Path, h)
+		if serve.Host == "" {
+			registered[serve.Path] = true
+		}
+	}
+	for _, redirect := range cfg.Redirects {
+		if redirect.Regex {
+			mux.HandlePattern(regexp.MustCompile(redirect.From), redirect.handler())
+		} else if !registered[redirect.From] {
+			// Overlapping redirects have been warned about by check()
+			mux.Handle(redirect.From, redirect.handler())
+			registered[redirect.From] = true
+		}
+	}
+	return mux, nil
+}
 
-	httpsEnabled := flag.Bool("https", false, "Enable HTTPS listener")
-	httpsAddr := flag.String("https.addr", ":8443", "HTTPS address")
-	httpsGzip := flag.Bool("https.gzip", true, "Enable HTTPS gzip compression")
-	httpsKey := flag.String("https.key", "", "Path to HTTPS key")
-	httpsCert := flag.String("https.cert", "", "Path to HTTPS cert")
+// registerMIMETypes adds types, mapping extensions to content types, to those
+// known to the mime package (and so the file servers).
+func registerMIMETypes(types map[string]string) {
+	for ext, contentType := range types {
+		if err := mime.AddExtensionType(ext, contentType); err != nil {
+			log.Printf("Couldn't register MIME type for %s: %s\n", ext, err)
+		}
+	}
+}
 
-	flag.Parse()
+// protocolNames are the names of listener protocols used in logs.
+var protocolNames = map[string]string{
+	"http":  "HTTP",
+	"https": "HTTPS",
+	"unix":  "Unix socket",
+}
 
-	if *configPath == "" {
-		cfg.Listeners = []Listener{}
+// binding is a server's listener on a single address.
+type binding struct {
+	srv      *http.Server
+	listener Listener
+	addr     string
+	desc     string       // protocol and address, for logging
+	ln       net.Listener // nil until bound
+}
 
-		if *httpEnabled {
-			cfg.Listeners = append(cfg.Listeners, Listener{
-				Protocol: "http",
-				Addr:     *httpAddr,
-				Gzip:     *httpGzip,
-			})
+// serve serves requests on the binding until the server is shut down,
+// sending any other error that stops it to errs.
+func (b binding) serve(errs chan<- error) {
+	log.Printf("listening on %s\n", b.desc)
+	var err error
+	if b.listener.Protocol == "https" {
+		err = b.srv.ServeTLS(b.ln, "", "")
+	} else {
+		err = b.srv.Serve(b.ln)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		errs <- fmt.Errorf("%s: %s", b.desc, err)
+	}
+}
+
+// connCounter tracks the number of open connections across servers.
+type connCounter struct {
+	n int64
+}
+
+// track is suitable for use as an `http.Server.ConnState` hook.
+func (c *connCounter) track(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&c.n, 1)
+	case http.StateHijacked, http.StateClosed:
+		atomic.AddInt64(&c.n, -1)
+	}
+}
+
+func (c *connCounter) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// Server serves a config on its listeners. Its serves, errors and redirects
+// can be replaced while it's running, but changes to anything else require a
+// new Server.
+type Server struct {
+	// BestEffort makes Start serve on whichever addresses can be bound,
+	// rather than failing if any can't be.
+	BestEffort bool
+
+	mux        atomic.Value // the current *StaticServeMux
+	servers    []*http.Server
+	bindings   []binding
+	certs      []*certificates          // reloaded by ReloadCertificates
+	logFiles   map[string]*rotatingFile // access log files, rotated by RotateAccessLog
+	limiters   []*RateLimiter           // stopped by Shutdown
+	errs       chan error               // listeners that stopped serving
+	conns      connCounter
+	ready      int32         // set to 1 once all listeners are bound
+	draining   int32         // set to 1 once shutting down
+	drainDelay time.Duration // time new requests are refused before shutdown
+}
+
+// NewServer sets up a server for cfg, which is sanitised and checked first.
+// Nothing is served until Start is called.
+func NewServer(cfg ServerConfig) (_ *Server, err error) {
+	// Copy the listeners, as certificate managers are attached to them below
+	cfg.Listeners = append([]Listener(nil), cfg.Listeners...)
+	cfg.Sanitise()
+	if !cfg.Check() {
+		return nil, errors.New("invalid config")
+	}
+	s := &Server{}
+	s.drainDelay, _ = time.ParseDuration(cfg.DrainDelay)
+
+	registerMIMETypes(cfg.MIMETypes)
+
+	// Setup handlers. The mux is held in an atomic.Value so it can be
+	// replaced when the config is reloaded.
+	m, err := buildMux(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s.mux.Store(m)
+	var mux http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mux.Load().(*StaticServeMux).ServeHTTP(w, r)
+	})
+	if cfg.MaintenanceFile != "" {
+		// Without a page of its own, the 503 error page is served
+		var unavailable http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.mux.Load().(*StaticServeMux).intercept(http.StatusServiceUnavailable, w, r)
+		})
+		if cfg.MaintenancePage != "" {
+			unavailable = MaintenancePageHandler(cfg.MaintenancePage)
 		}
-		if *httpsEnabled {
-			cfg.Listeners = append(cfg.Listeners, Listener{
-				Protocol: "https",
-				Addr:     *httpsAddr,
-				Gzip:     *httpsGzip,
-				KeyFile:  *httpsKey,
-				CertFile: *httpsCert,
-			})
+		mux = MaintenanceHandler(mux, cfg.MaintenanceFile, cfg.MaintenanceAllow, unavailable)
+	}
+
+	// Listeners without access logs of their own use the global one
+	s.logFiles = make(map[string]*rotatingFile)
+	defer func() {
+		if err != nil {
+			s.release()
 		}
+	}()
+	var accessLogger *AccessLogger
+	if cfg.AccessLog != nil {
+		if accessLogger, err = cfg.AccessLog.open(s.logFiles); err != nil {
+			return nil, fmt.Errorf("couldn't open access log: %s", err)
+		}
+	}
 
-		// Serve from first path given on cmdline
-		target := flag.Arg(0)
-		if target == "" {
-			target = "."
+	// Set up certificate managers ahead of the listeners, as HTTP listeners
+	// must answer challenges for HTTPS listeners' domains
+	acmeManagers := make(map[string]*autocert.Manager)
+	for i, l := range cfg.Listeners {
+		if l.ACME != nil {
+			m := l.ACME.manager()
+			cfg.Listeners[i].acmeManager = m
+			for _, domain := range l.ACME.Domains {
+				acmeManagers[strings.ToLower(domain)] = m
+			}
 		}
+	}
 
-		cfg.Serves = []Serve{
-			Serve{
-				Path:    "/",
-				Target:  target,
-				Indexes: *indexes,
-			},
+	if cfg.Metrics != nil {
+		recorder := NewMetricsRecorder()
+		mux = MetricsHandler(mux, recorder)
+		srv := cfg.Metrics.server(recorder)
+		s.servers = append(s.servers, srv)
+		s.bindings = append(s.bindings, binding{
+			srv:      srv,
+			listener: Listener{Protocol: "http"},
+			addr:     cfg.Metrics.Addr,
+			desc:     "metrics " + cfg.Metrics.Addr + cfg.Metrics.Path,
+		})
+	}
+	for i := range cfg.Listeners {
+		listener := cfg.Listeners[i]
+		listener.accessLogger = accessLogger
+		if listener.AccessLog != nil {
+			l, err := listener.AccessLog.open(s.logFiles)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't open access log: %s", err)
+			}
+			listener.accessLogger = l
 		}
-	} else {
-		var err error
-		cfg, err = readServerConfig(*configPath)
-		if err != nil {
-			log.Fatalln("Couldn't load config:", err)
+		if listener.RateLimit != nil {
+			listener.rateLimiter = NewRateLimiter(*listener.RateLimit)
+			s.limiters = append(s.limiters, listener.rateLimiter)
 		}
-	}
+		if listener.Protocol == "https" && listener.ACME == nil {
+			c, err := loadCertificates(listener.certificatePairs())
+			if err != nil {
+				return nil, fmt.Errorf("couldn't load certificates: %s", err)
+			}
+			listener.certs = c
+			s.certs = append(s.certs, c)
+		}
+		if listener.ClientCA != "" {
+			pool, err := loadClientCAs(listener.ClientCA)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't load client CA: %s", err)
+			}
+			listener.clientCAs = pool
+		}
+
+		var h http.Handler = mux
+		if listener.RedirectToHTTPS {
+			h = HTTPSRedirectHandler(listener.HTTPSPort)
+		}
+		// The timeout applies within the middleware, so compression and
+		// custom headers aren't counted against it
+		if listener.requestTimeout > 0 {
+			h = http.TimeoutHandler(h, listener.requestTimeout, listener.TimeoutMessage)
+		}
+		if listener.MaxRequestBody != "" {
+			limit, _ := parseSize(listener.MaxRequestBody)
+			h = MaxRequestBodyHandler(h, limit)
+		}
+		if listener.MaxConnections > 0 {
+			h = MaxConnectionsHandler(h, listener.MaxConnections)
+		}
+		if len(listener.AllowedHosts) > 0 {
+			h = AllowedHostsHandler(h, listener.AllowedHosts)
+		}
+		h = applyMiddleware(h, &listener, middlewareOrder(cfg.MiddlewareOrder))
+		h = DrainingHandler(h, s.Draining)
 
-	cfg.sanitise()
+		// Health checks bypass the middleware and serves entirely
+		healthPath, readinessPath := listener.HealthPath, listener.ReadinessPath
+		if healthPath == "" {
+			healthPath = cfg.HealthPath
+		}
+		if readinessPath == "" {
+			readinessPath = cfg.ReadinessPath
+		}
+		if healthPath != "" || readinessPath != "" {
+			h = HealthHandler(h, healthPath, readinessPath, s.Ready)
+		}
+		if listener.Protocol == "http" && len(acmeManagers) > 0 {
+			h = ACMEChallengeHandler(h, acmeManagers)
+		}
+		if listener.ServerHeader != "" {
+			h = ServerHeaderHandler(h, listener.ServerHeader)
+		}
+		if listener.ClientCertHeader != "" {
+			h = ClientCertHandler(h, listener.ClientCertHeader)
+		}
+		if cfg.RequestIDHeader != "" {
+			h = RequestIDHandler(h, cfg.RequestIDHeader)
+		}
+		h = RequestInfoHandler(h, &listener)
+		srv := listener.server(h)
+		srv.ConnState = s.conns.track
+		s.servers = append(s.servers, srv)
+		for _, addr := range listener.addresses() {
+			s.bindings = append(s.bindings, binding{
+				srv:      srv,
+				listener: listener,
+				addr:     addr,
+				desc:     protocolNames[listener.Protocol] + " " + addr,
+			})
+		}
+	}
+	s.errs = make(chan error, len(s.bindings))
+	return s, nil
+}
 
-	if *echoConfig {
-		b, err := yaml.Marshal(cfg)
+// Start binds all of the server's addresses, then serves on them in the
+// background. If any can't be bound, an error is returned and nothing is
+// served, unless BestEffort is set and at least one address was bound.
+// Addresses are retried according to their listeners' bind-retries first.
+func (s *Server) Start() error {
+	failures, bound := 0, 0
+	for i, b := range s.bindings {
+		ln, err := b.listener.listenRetrying(b.addr, b.desc)
 		if err != nil {
-			log.Fatalln(err)
+			log.Printf("Couldn't listen on %s: %s\n", b.desc, err)
+			failures++
+			continue
 		}
-		print(string(b))
+		s.bindings[i].ln = ln
+		bound++
 	}
 
-	if !cfg.check() {
-		log.Fatalln("Invalid config. Exiting.")
+	if failures > 0 && (!s.BestEffort || bound == 0) {
+		for i, b := range s.bindings {
+			if b.ln != nil {
+				b.ln.Close()
+				s.bindings[i].ln = nil
+			}
+		}
+		return fmt.Errorf("couldn't listen on %d address(es)", failures)
+	}
+	for _, b := range s.bindings {
+		if b.ln != nil {
+			go b.serve(s.errs)
+		}
 	}
 
-	if *checkConfig {
-		log.Println("Config check passed.")
+	// All listeners are bound, so the server is ready
+	atomic.StoreInt32(&s.ready, 1)
+	return nil
+}
+
+// Errors returns a channel that receives an error for each listener that
+// stops serving before the server is shut down.
+func (s *Server) Errors() <-chan error {
+	return s.errs
+}
+
+// Ready returns true once the server has started, until it starts shutting
+// down.
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.ready) == 1 && !s.Draining()
+}
+
+// Draining returns true once the server has started shutting down, after
+// which new requests are refused with `503 Service Unavailable`.
+func (s *Server) Draining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// Reload replaces the server's serves, errors and redirects with those of
+// cfg, which is sanitised and checked first. Changes to listeners and other
+// options in cfg are ignored. If cfg is invalid, or its serves can't be set
+// up, an error is returned and the current ones are kept.
+func (s *Server) Reload(cfg ServerConfig) error {
+	cfg.Sanitise()
+	if !cfg.Check() {
+		return errors.New("invalid config")
+	}
+	mux, err := buildMux(cfg)
+	if err != nil {
+		return err
 	}
+	registerMIMETypes(cfg.MIMETypes)
+	s.mux.Store(mux)
+	return nil
+}
 
-	if *echoConfig || *checkConfig {
-		os.Exit(0)
+// ReloadCertificates reloads HTTPS listeners' certificates from disk, such as
+// after they have been renewed. Listeners whose certificates fail to load
+// keep their current ones.
+func (s *Server) ReloadCertificates() (err error) {
+	for _, c := range s.certs {
+		if e := c.reload(); e != nil {
+			err = e
+		}
 	}
+	return
 }
 
-func readServerConfig(filename string) (cfg ServerConfig, err error) {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return
+// RotateAccessLog rotates the access log files, where they're configured to
+// be rotated, or otherwise opens them again, as needed after they've been
+// moved aside by another tool. Logs written to stdout or stderr are
+// unaffected.
+func (s *Server) RotateAccessLog() (err error) {
+	for _, f := range s.logFiles {
+		if e := f.Rotate(); e != nil {
+			err = e
+		}
 	}
-	err = yaml.Unmarshal(data, &cfg)
 	return
 }
 
-func main() {
-	// Setup handlers
-	mux := NewStaticServeMux()
-	for _, e := range cfg.Errors {
-		mux.HandleError(e.Status, e.handler())
+// Shutdown gracefully stops the server, allowing in-flight requests to
+// complete until ctx is done, after which any remaining connections are
+// closed. New requests are refused from the start, and the listeners are
+// kept open for the config's drain-delay first, so that load balancers can
+// see the server is going away.
+func (s *Server) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&s.draining, 1)
+	if s.drainDelay > 0 {
+		log.Printf("Refusing new requests for %s before shutting down\n", s.drainDelay)
+		select {
+		case <-time.After(s.drainDelay):
+		case <-ctx.Done():
+		}
 	}
-	for _, serve := range cfg.Serves {
-		mux.Handle(serve.Path, serve.handler())
+
+	open := s.conns.count()
+	log.Printf("Shutting down, draining %d connection(s)\n", open)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	timedOut := []*http.Server{}
+	for _, srv := range s.servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				mu.Lock()
+				timedOut = append(timedOut, srv)
+				mu.Unlock()
+			}
+		}(srv)
 	}
-	for _, redirect := range cfg.Redirects {
-		mux.Handle(redirect.From, redirect.handler())
+	wg.Wait()
+
+	remaining := s.conns.count()
+	for _, srv := range timedOut {
+		srv.Close()
 	}
+	log.Printf("Drained %d connection(s), closed %d\n", open-remaining, remaining)
 
-	// Start listeners
-	for i := range cfg.Listeners {
-		listener := cfg.Listeners[i]
+	s.release()
+	if len(timedOut) > 0 {
+		return ctx.Err()
+	}
+	return nil
+}
 
-		var h http.Handler = mux
-		if len(listener.Headers) > 0 {
-			h = CustomHeadersHandler(h, listener.Headers)
-		}
-		if listener.Gzip {
-			h = GzipHandler(h)
-		}
-		if listener.Protocol == "http" {
-			go func() {
-				log.Printf("listening on HTTP %s\n", listener.Addr)
-				err := http.ListenAndServe(listener.Addr, h)
-				if err != nil {
-					log.Fatalln(err)
-				}
-			}()
-		} else if listener.Protocol == "https" {
-			go func() {
-				log.Printf("listening on HTTPS %s\n", listener.Addr)
-				err := http.ListenAndServeTLS(listener.Addr, listener.CertFile, listener.KeyFile, h)
-				if err != nil {
-					log.Fatalln(err)
-				}
-			}()
-		} else {
-			log.Printf("Unsupported protocol %s\n", listener.Protocol)
-		}
-	}
-
-	// Since all the listeners are running in separate gorotines, we have to
-	// wait here for a termination signal.
-	exit := make(chan os.Signal, 1)
-	signal.Notify(exit, os.Interrupt, syscall.SIGTERM)
-	<-exit
-	os.Exit(0)
+// release stops the server's rate limiters and closes its access logs.
+func (s *Server) release() {
+	for _, l := range s.limiters {
+		l.Stop()
+	}
+	// Nothing more will be logged, so compressed logs can be finished
+	for _, f := range s.logFiles {
+		if err := f.Close(); err != nil {
+			log.Printf("Couldn't close access log %s: %s\n", f.path, err)
+		}
+	}
 }
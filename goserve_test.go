@@ -0,0 +1,272 @@
+package goserve
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeFiles creates the given files, by path relative to a new temporary
+// directory, which is returned.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// newTestServer returns a server for cfg, adding a listener if it has none.
+func newTestServer(t *testing.T, cfg ServerConfig) *Server {
+	t.Helper()
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = []Listener{{Protocol: "http", Addr: "127.0.0.1:0"}}
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %s", err)
+	}
+	return s
+}
+
+// testHandler returns the handler of the server's first listener, including
+// its middleware, for cfg.
+func testHandler(t *testing.T, cfg ServerConfig) http.Handler {
+	t.Helper()
+	return newTestServer(t, cfg).servers[0].Handler
+}
+
+// get makes a request of h, with the given headers as name/value pairs.
+func get(h http.Handler, method, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestNewServer(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"index.html": "home", "a.txt": "a"})
+	h := testHandler(t, ServerConfig{
+		Serves:    []Serve{{Path: "/", Target: dir}},
+		Redirects: []Redirect{{From: "/old", To: "/a.txt"}},
+	})
+	for _, c := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", http.StatusOK, "home"},
+		{"/a.txt", http.StatusOK, "a"},
+		{"/missing", http.StatusForbidden, "Forbidden\n"},
+		{"/old", http.StatusMovedPermanently, ""},
+	} {
+		w := get(h, "GET", c.path)
+		if w.Code != c.status {
+			t.Errorf("%s: got status %d, want %d", c.path, w.Code, c.status)
+		}
+		if c.body != "" && w.Body.String() != c.body {
+			t.Errorf("%s: got body %q, want %q", c.path, w.Body.String(), c.body)
+		}
+	}
+}
+
+func TestNewServerInvalid(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"index.html": "home"})
+	listeners := []Listener{{Protocol: "http", Addr: "127.0.0.1:0"}}
+	for name, cfg := range map[string]ServerConfig{
+		"duplicate serves": {Serves: []Serve{{Path: "/", Target: dir}, {Path: "/", Target: dir}}},
+		"duplicate internal serves": {Serves: []Serve{{Path: "/", Target: dir},
+			{Path: "/p/", Target: dir, Internal: true}, {Path: "/p/", Target: dir, Internal: true}}},
+		"duplicate errors": {Serves: []Serve{{Path: "/", Target: dir}}, Errors: []Error{
+			{Status: 404, Target: filepath.Join(dir, "index.html")},
+			{Status: 404, Target: filepath.Join(dir, "index.html")}}},
+	} {
+		cfg.Listeners = listeners
+		if _, err := NewServer(cfg); err == nil {
+			t.Errorf("%s: NewServer succeeded", name)
+		}
+	}
+}
+
+func TestBuildMuxErrors(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"site.zip": "not a zip"})
+	for name, cfg := range map[string]ServerConfig{
+		"zip target": {Serves: []Serve{{Path: "/", Target: zipTargetPrefix + filepath.Join(dir, "site.zip")}}},
+		"response":   {Serves: []Serve{{Path: "/", Response: filepath.Join(dir, "missing.http")}}},
+		"listing template": {Serves: []Serve{{Path: "/", Target: dir, Indexes: true,
+			ListingTemplate: filepath.Join(dir, "missing.tmpl")}}},
+		"duplicate serves": {Serves: []Serve{{Path: "/", Target: dir}, {Path: "/", Target: dir}}},
+	} {
+		if _, err := buildMux(cfg); err == nil {
+			t.Errorf("%s: buildMux succeeded", name)
+		}
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"index.html": "home"})
+	cfg := ServerConfig{
+		Listeners: []Listener{{Protocol: "http", Addr: "127.0.0.1:0"}},
+		Serves:    []Serve{{Path: "/", Target: dir}},
+	}
+	s := newTestServer(t, cfg)
+	defer s.Shutdown(context.Background())
+
+	bad := cfg
+	bad.Serves = []Serve{{Path: "/", Target: dir}, {Path: "/", Target: dir}}
+	if err := s.Reload(bad); err == nil {
+		t.Error("Reload of duplicate serves succeeded")
+	}
+	bad.Serves = []Serve{{Path: "/", Target: zipTargetPrefix + filepath.Join(dir, "index.html")}}
+	if err := s.Reload(bad); err == nil {
+		t.Error("Reload of invalid zip target succeeded")
+	}
+	if w := get(s.servers[0].Handler, "GET", "/"); w.Body.String() != "home" {
+		t.Errorf("after failed reloads, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestShutdownStopsRateLimiters(t *testing.T) {
+	s := newTestServer(t, ServerConfig{
+		Listeners: []Listener{{Protocol: "http", Addr: "127.0.0.1:0",
+			RateLimit: &RateLimit{RequestsPerSecond: 10}}},
+		Serves: []Serve{{Path: "/", Status: http.StatusNoContent}},
+	})
+	if len(s.limiters) != 1 {
+		t.Fatalf("got %d rate limiters", len(s.limiters))
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.limiters[0].stop:
+	default:
+		t.Error("rate limiter wasn't stopped")
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("GOSERVE_TEST_ROOT", "/srv/www")
+	os.Unsetenv("GOSERVE_TEST_UNSET")
+	for in, want := range map[string]string{
+		"target: $GOSERVE_TEST_ROOT":         "target: /srv/www",
+		"target: ${GOSERVE_TEST_ROOT}/site":  "target: /srv/www/site",
+		"target: ${GOSERVE_TEST_UNSET}/site": "target: /site",
+		"target: $GOSERVE_TEST_UNSET":        "target: ",
+		"price: $$5":                         "price: $5",
+		"no variables":                       "no variables",
+	} {
+		if got := string(expandEnv([]byte(in))); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestReadServerConfigEnv(t *testing.T) {
+	t.Setenv("GOSERVE_TEST_ROOT", "/srv/www")
+	dir := writeFiles(t, map[string]string{"goserve.yaml": "serves:\n  - path: /\n    target: ${GOSERVE_TEST_ROOT}\n"})
+	cfg, err := ReadServerConfig(filepath.Join(dir, "goserve.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Serves) != 1 || cfg.Serves[0].Target != "/srv/www" {
+		t.Errorf("got serves %+v", cfg.Serves)
+	}
+}
+
+func TestDraining(t *testing.T) {
+	s := newTestServer(t, ServerConfig{Serves: []Serve{{Path: "/", Status: http.StatusNoContent}}})
+	h := s.servers[0].Handler
+	if w := get(h, "GET", "/"); w.Code != http.StatusNoContent {
+		t.Fatalf("before draining, got %d", w.Code)
+	}
+	atomic.StoreInt32(&s.draining, 1)
+	if !s.Draining() {
+		t.Error("not draining")
+	}
+	w := get(h, "GET", "/")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("while draining, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("Connection") != "close" {
+		t.Errorf("while draining, got headers %v", w.Header())
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	srv := newTestServer(t, ServerConfig{
+		Serves: []Serve{{Path: "/", Target: writeFiles(t, nil)}},
+	})
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	// Closing a listener out from under its server stops it serving
+	srv.bindings[0].ln.Close()
+	select {
+	case err := <-srv.Errors():
+		if !strings.HasPrefix(err.Error(), "HTTP 127.0.0.1:0: ") {
+			t.Errorf("expected error for listener, got %q", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected error once listener closed")
+	}
+}
+
+func TestNewServerReleasesOnError(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"invalid.crt": "not a certificate",
+		"invalid.key": "not a key",
+	})
+	logPath := filepath.Join(dir, "access.log.gz")
+	_, err := NewServer(ServerConfig{
+		Listeners: []Listener{{
+			Protocol:  "http",
+			Addr:      "127.0.0.1:0",
+			AccessLog: &AccessLog{Path: logPath, Gzip: true},
+			RateLimit: &RateLimit{RequestsPerSecond: 10},
+		}, {
+			Protocol: "https",
+			Addr:     "127.0.0.1:1",
+			CertFile: filepath.Join(dir, "invalid.crt"),
+			KeyFile:  filepath.Join(dir, "invalid.key"),
+		}},
+		Serves: []Serve{{Path: "/", Target: dir}},
+	})
+	if err == nil {
+		t.Fatal("expected error for invalid certificate")
+	}
+
+	// Only closing the log finishes its gzip stream
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("expected access log to be closed, got %s", err)
+	}
+	if _, err := ioutil.ReadAll(zr); err != nil {
+		t.Errorf("expected access log to be closed, got %s", err)
+	}
+}
@@ -0,0 +1,109 @@
+package goserve
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// gzipFlushInterval is how often compressed logs are flushed, so that recent
+// lines can be read from them.
+const gzipFlushInterval = 5 * time.Second
+
+// errGzipFinished is returned by writes to a gzipLog between members.
+var errGzipFinished = errors.New("gzip member finished")
+
+// gzipLog compresses a log as it's written, as a series of gzip members.
+// Finishing a member leaves a complete gzip file, which can be appended to
+// by starting another, as gzip tools read consecutive members as one. The
+// current member is flushed periodically, so that recent lines can be read
+// before it's finished.
+type gzipLog struct {
+	name string // for logging
+
+	mu    sync.Mutex
+	gz    *gzip.Writer  // nil between members
+	dirty bool          // whether gz has unflushed content
+	done  chan struct{} // closed to stop flushing
+}
+
+// newGzipLog starts compressing to w, flushing at the given interval until
+// closed. name identifies the log in errors.
+func newGzipLog(w io.Writer, name string, interval time.Duration) *gzipLog {
+	g := &gzipLog{name: name, done: make(chan struct{})}
+	g.start(w)
+	go g.flushEvery(interval, g.done)
+	return g
+}
+
+func (g *gzipLog) Write(b []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gz == nil {
+		return 0, errGzipFinished
+	}
+	g.dirty = true
+	return g.gz.Write(b)
+}
+
+// start starts a new member, written to w.
+func (g *gzipLog) start(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.gz, g.dirty = gzip.NewWriter(w), false
+}
+
+// finish finishes the current member, if any, so that nothing more is
+// written until the next is started.
+func (g *gzipLog) finish() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gz == nil {
+		return nil
+	}
+	err := g.gz.Close()
+	g.gz, g.dirty = nil, false
+	return err
+}
+
+// flush writes out anything compressed since the last flush.
+func (g *gzipLog) flush() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.gz == nil || !g.dirty {
+		return nil
+	}
+	g.dirty = false
+	return g.gz.Flush()
+}
+
+// flushEvery flushes the log at the given interval, until done is closed.
+func (g *gzipLog) flushEvery(interval time.Duration, done chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := g.flush(); err != nil {
+				log.Printf("Couldn't flush %s: %s\n", g.name, err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Close stops flushing the log, and finishes the current member. The
+// underlying writer is left open.
+func (g *gzipLog) Close() error {
+	g.mu.Lock()
+	if g.done != nil {
+		close(g.done)
+		g.done = nil
+	}
+	g.mu.Unlock()
+	return g.finish()
+}
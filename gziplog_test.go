@@ -0,0 +1,89 @@
+package goserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGzipLog(t *testing.T) {
+	var first, second bytes.Buffer
+	g := newGzipLog(&first, "test.log.gz", time.Hour)
+	g.Write([]byte("one\n"))
+
+	// Flushed content can be read before the member is finished
+	if err := g.flush(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(first.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(zr); !strings.HasPrefix(string(b), "one\n") {
+		t.Errorf("flushed log contains %q", b)
+	}
+
+	// Nothing is written between members
+	if err := g.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Write([]byte("lost\n")); err != errGzipFinished {
+		t.Errorf("expected error writing between members, got %v", err)
+	}
+	g.start(&first)
+	g.Write([]byte("two\n"))
+	g.finish()
+	g.start(&second)
+	g.Write([]byte("three\n"))
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each writer holds complete members, read as one
+	for _, c := range []struct {
+		buf  *bytes.Buffer
+		want string
+	}{
+		{&first, "one\ntwo\n"},
+		{&second, "three\n"},
+	} {
+		zr, err := gzip.NewReader(c.buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ioutil.ReadAll(zr); err != nil || string(b) != c.want {
+			t.Errorf("got %q (%v), expected %q", b, err, c.want)
+		}
+	}
+}
+
+func TestGzipLogFlushEvery(t *testing.T) {
+	var buf bytes.Buffer
+	g := newGzipLog(&buf, "test.log.gz", time.Millisecond)
+	defer g.Close()
+	g.Write([]byte("line\n"))
+	flushed := func() bool {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return !g.dirty
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !flushed() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected log to be flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	zr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(zr); string(b) != "line\n" {
+		t.Errorf("flushed log contains %q", b)
+	}
+}
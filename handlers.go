@@ -1,16 +1,45 @@
-package main
+package goserve
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
 	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
 )
 
+// SendfileHeader is the response header naming a file to be served, from an
+// internal serve, in place of the response that set it.
+const SendfileHeader = "X-Goserve-Sendfile"
+
 // StaticServeMux wraps ServeMux but allows for the interception of errors.
 type StaticServeMux struct {
 	*http.ServeMux
-	errors map[int]http.Handler
+	errors   map[int]http.Handler
+	patterns []patternRoute
+	hosts    map[string]*http.ServeMux // by host name or wildcard
+	internal *http.ServeMux            // reached only through SendfileHeader
+}
+
+// patternRoute routes requests with paths matching a regular expression.
+type patternRoute struct {
+	re      *regexp.Regexp
+	handler http.Handler
 }
 
 // NewStaticServeMux allocates and returns a new StaticServeMux
@@ -18,9 +47,18 @@ func NewStaticServeMux() *StaticServeMux {
 	return &StaticServeMux{
 		ServeMux: http.NewServeMux(),
 		errors:   make(map[int]http.Handler),
+		hosts:    make(map[string]*http.ServeMux),
+		internal: http.NewServeMux(),
 	}
 }
 
+// HandleInternal registers a handler for the given pattern that can't be
+// requested directly, but only by naming a file under it in a response's
+// SendfileHeader.
+func (s *StaticServeMux) HandleInternal(pattern string, handler http.Handler) {
+	s.internal.Handle(pattern, handler)
+}
+
 // HandleError registers a handler for the given response code.
 func (s *StaticServeMux) HandleError(status int, handler http.Handler) {
 	if s.errors[status] != nil {
@@ -29,8 +67,93 @@ func (s *StaticServeMux) HandleError(status int, handler http.Handler) {
 	s.errors[status] = handler
 }
 
+// HandlePattern registers a handler for request paths matching re. Patterns
+// are tried in the order registered, before any other routes.
+func (s *StaticServeMux) HandlePattern(re *regexp.Regexp, handler http.Handler) {
+	s.patterns = append(s.patterns, patternRoute{re, handler})
+}
+
+// HandleHost registers a handler for the given pattern on requests for host,
+// which may be a wildcard such as "*.example.com" matching all of its
+// subdomains. Requests for a host are routed to its handlers in preference to
+// those of matching wildcards (the most specific first), then to those
+// registered without a host.
+func (s *StaticServeMux) HandleHost(host, pattern string, handler http.Handler) {
+	if host == "" {
+		s.Handle(pattern, handler)
+		return
+	}
+	host = strings.ToLower(host)
+	if s.hosts[host] == nil {
+		s.hosts[host] = http.NewServeMux()
+	}
+	s.hosts[host].Handle(pattern, handler)
+}
+
+// requestHost returns the host name requested, lowercased and without any
+// port or trailing dot.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// matchHost returns true if host is one of hosts, or a subdomain of a domain
+// given as a wildcard such as "*.example.com".
+func matchHost(host string, hosts []string) bool {
+	for _, h := range hosts {
+		if host == h || strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedHostsHandler responds to requests for hosts other than those given
+// (as matched by matchHost) with `421 Misdirected Request`, rather than
+// passing them on to h, to guard against forged Host headers.
+func AllowedHostsHandler(h http.Handler, hosts []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !matchHost(requestHost(r), hosts) {
+			http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// hostHandler returns the handler registered for the request's host, or for
+// a wildcard matching it, that matches the request path, if any.
+func (s *StaticServeMux) hostHandler(r *http.Request) http.Handler {
+	if len(s.hosts) == 0 {
+		return nil
+	}
+	host := requestHost(r)
+	for name := host; name != ""; {
+		if mux := s.hosts[name]; mux != nil {
+			if h, pattern := mux.Handler(r); pattern != "" {
+				return h
+			}
+		}
+		// Try the wildcard for the next domain up
+		i := strings.IndexByte(strings.TrimPrefix(name, "*."), '.')
+		if i < 0 {
+			break
+		}
+		name = "*" + strings.TrimPrefix(name, "*.")[i:]
+	}
+	return nil
+}
+
 func (s StaticServeMux) intercept(status int, w http.ResponseWriter, req *http.Request) bool {
-	// Get error handler if there is one
+	// Get error handler if there is one, preferring the matched serve's own
+	if h := GetRequestInfo(req).Serve.errorHandler(status); h != nil {
+		h.ServeHTTP(statusResponseWriter{w, status}, req)
+		return true
+	}
 	if h, f := s.errors[status]; f {
 		h.ServeHTTP(statusResponseWriter{w, status}, req)
 		return true
@@ -43,22 +166,49 @@ func (s StaticServeMux) intercept(status int, w http.ResponseWriter, req *http.R
 	return true
 }
 
-func (s *StaticServeMux) interceptHandler(handler http.Handler) http.Handler {
+// sendfile serves the named file from the internal serve for it, in place of
+// the response that named it. Headers set for that response are kept, except
+// Content-Length, so it can set e.g. Content-Disposition.
+func (s *StaticServeMux) sendfile(name string, w http.ResponseWriter, r *http.Request) {
+	r2 := rewritePath(r, path.Clean("/"+name))
+	h, pattern := s.internal.Handler(r2)
+	if pattern == "" {
+		log.Printf("No internal serve for %s `%s` from %s\n", SendfileHeader, name, r.URL.Path)
+		s.intercept(http.StatusInternalServerError, w, r)
+		return
+	}
+	w.Header().Del("Content-Length")
+	s.interceptHandler(h, false).ServeHTTP(w, r2)
+}
+
+// interceptHandler intercepts errors from handler, and files named by its
+// responses' SendfileHeader if sendfile is set.
+func (s *StaticServeMux) interceptHandler(handler http.Handler, sendfile bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		irw := &InterceptResponseWriter{
 			ResponseWriter: w,
 			r:              r,
 			m:              s,
+			sendfile:       sendfile,
 		}
 
 		// If intercept occurred, originating call would have been panic'd.
-		// Recover here once error has been dealt with.
+		// Recover here once error has been dealt with. Any other panic is
+		// logged and, if nothing has been written yet, answered with a 500.
 		defer func() {
 			if p := recover(); p != nil {
 				if p == irw {
 					return
 				}
-				panic(p)
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				log.Printf("Panic serving %s: %v\n%s", r.URL.Path, p, debug.Stack())
+				if irw.wroteHeader {
+					// Too late to respond, so drop the connection
+					panic(http.ErrAbortHandler)
+				}
+				s.intercept(http.StatusInternalServerError, w, r)
 			}
 		}()
 
@@ -74,25 +224,55 @@ func (s *StaticServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	h, _ := s.Handler(r)
-	h = s.interceptHandler(h)
+	// Handlers record their state in the request's RequestInfo, so make
+	// sure it has one even if it didn't come through a listener
+	r = ensureRequestInfo(r)
+	h := s.hostHandler(r)
+	if h == nil {
+		h, _ = s.Handler(r)
+	}
+	for _, p := range s.patterns {
+		if p.re.MatchString(r.URL.Path) {
+			h = p.handler
+			break
+		}
+	}
+	h = s.interceptHandler(h, true)
 	h.ServeHTTP(w, r)
 }
 
 type InterceptResponseWriter struct {
 	http.ResponseWriter
-	r *http.Request
-	m *StaticServeMux
+	r           *http.Request
+	m           *StaticServeMux
+	wroteHeader bool
+	sendfile    bool // serve files named by SendfileHeader
 }
 
 func (h *InterceptResponseWriter) WriteHeader(status int) {
-	if h.m.intercept(status, h.ResponseWriter, h.r) {
+	if name := h.Header().Get(SendfileHeader); name != "" {
+		h.Header().Del(SendfileHeader)
+		if h.sendfile {
+			h.m.sendfile(name, h.ResponseWriter, h.r)
+			panic(h)
+		}
+	}
+	if !GetRequestInfo(h.r).Verbatim && h.m.intercept(status, h.ResponseWriter, h.r) {
 		panic(h)
 	} else {
+		h.wroteHeader = true
 		h.ResponseWriter.WriteHeader(status)
 	}
 }
 
+func (h *InterceptResponseWriter) Write(b []byte) (int, error) {
+	if !h.wroteHeader && h.Header().Get(SendfileHeader) != "" {
+		h.WriteHeader(http.StatusOK)
+	}
+	h.wroteHeader = true
+	return h.ResponseWriter.Write(b)
+}
+
 type statusResponseWriter struct {
 	http.ResponseWriter
 	Status int
@@ -102,22 +282,91 @@ func (h statusResponseWriter) WriteHeader(status int) {
 	if h.Status < 0 {
 		return
 	}
-	if h.Status > 0 {
+	// Unchanged pages are still reported as such to conditional requests
+	if h.Status > 0 && status != http.StatusNotModified {
 		h.ResponseWriter.WriteHeader(h.Status)
 		return
 	}
 	h.ResponseWriter.WriteHeader(status)
 }
 
+// MirrorDirs is a file system reading from several identical ones, to spread
+// the load between them. Each file or directory is opened from one chosen at
+// random in proportion to its weight, or if that fails, from each of the
+// others in turn.
+type MirrorDirs struct {
+	dirs    []http.FileSystem
+	weights []int
+	total   int
+}
+
+// add adds a file system with the given weight.
+func (m *MirrorDirs) add(fs http.FileSystem, weight int) {
+	m.dirs = append(m.dirs, fs)
+	m.weights = append(m.weights, weight)
+	m.total += weight
+}
+
+// pick returns the index of a file system chosen at random by weight.
+func (m *MirrorDirs) pick() int {
+	if m.total == 0 {
+		return 0
+	}
+	n := rand.Intn(m.total)
+	for i, w := range m.weights {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return 0
+}
+
+func (m *MirrorDirs) Open(name string) (http.File, error) {
+	first := m.pick()
+	f, err := m.dirs[first].Open(name)
+	if err == nil {
+		return f, nil
+	}
+	for i, fs := range m.dirs {
+		if i == first {
+			continue
+		}
+		if f, e := fs.Open(name); e == nil {
+			return f, nil
+		}
+	}
+	return nil, err
+}
+
+// MultiDir is a file system searching several others in order, opening each
+// file or directory from the first that contains it. Directories aren't
+// merged, so are listed as they are in the first that contains them.
+type MultiDir []http.FileSystem
+
+func (m MultiDir) Open(name string) (http.File, error) {
+	var firstErr error
+	for _, fs := range m {
+		f, err := fs.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
 // PreventListingDir panics whenever a file open fails, allowing index
 // requests to be intercepted.
 type PreventListingDir struct {
-	http.Dir
+	http.FileSystem
 }
 
 // Open panics whenever opening a file fails.
 func (dir *PreventListingDir) Open(name string) (f http.File, err error) {
-	f, err = dir.Dir.Open(name)
+	f, err = dir.FileSystem.Open(name)
 	if f == nil {
 		panic(dir)
 	}
@@ -125,8 +374,10 @@ func (dir *PreventListingDir) Open(name string) (f http.File, err error) {
 }
 
 // SuppressListingHandler returns a FileServer handler that does not permit
-// the listing of files.
-func SuppressListingHandler(dir http.Dir) http.Handler {
+// the listing of files. Directories without an index file, and missing files,
+// result in `403 Forbidden`, which the mux serves with the configured 403
+// error page, if any, like any other error.
+func SuppressListingHandler(dir http.FileSystem) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		d := &PreventListingDir{dir}
 		h := http.FileServer(d)
@@ -143,8 +394,779 @@ func SuppressListingHandler(dir http.Dir) http.Handler {
 	})
 }
 
+// SingleFileHandler serves the named file for requests to the exact path it
+// is mounted at (i.e. an empty path once the prefix has been stripped), and
+// responds with `404 Not Found` to requests for any subpath.
+func SingleFileHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, name)
+	})
+}
+
+// singleFileSystem is an http.FileSystem containing only the named file,
+// found at the empty path.
+type singleFileSystem string
+
+func (f singleFileSystem) Open(name string) (http.File, error) {
+	if name != "" {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(string(f))
+}
+
+// ExtensionlessHTMLHandler serves `name.html` for requests to `name` when
+// `name` has no extension and does not itself exist within dir. The request
+// URL is rewritten internally rather than redirected.
+func ExtensionlessHTMLHandler(h http.Handler, dir http.FileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if p != "" && !strings.HasSuffix(p, "/") && path.Ext(p) == "" &&
+			!exists(dir, p) && isFile(dir, p+".html") {
+			r = rewritePath(r, p+".html")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// PrecompressedHandler serves `name.gz`, with `Content-Encoding: gzip`, for
+// requests to `name` from clients that accept gzip when both exist within
+// dir. The Content-Type is that of `name`. Range requests are served from the
+// uncompressed file.
+func PrecompressedHandler(h http.Handler, dir http.FileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if p == "" || strings.HasSuffix(p, "/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		addVary(w.Header(), "Accept-Encoding")
+		if r.Header.Get("Range") != "" ||
+			negotiateEncoding(r.Header.Get("Accept-Encoding"), []string{"gzip"}) == "" ||
+			!isFile(dir, p) || !isFile(dir, p+".gz") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if ctype := fileContentType(dir, p); ctype != "" {
+			w.Header().Set("Content-Type", ctype)
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		h.ServeHTTP(w, rewritePath(r, p+".gz"))
+	})
+}
+
+// fileContentType returns the content type of the named file, by extension
+// or failing that by its content, as FileServer would.
+func fileContentType(dir http.FileSystem, name string) string {
+	if ctype := mime.TypeByExtension(path.Ext(name)); ctype != "" {
+		return ctype
+	}
+	f, err := dir.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(f, buf)
+	return http.DetectContentType(buf[:n])
+}
+
+// AddPrefixHandler prepends prefix to the request path before passing it on
+// to h.
+func AddPrefixHandler(h http.Handler, prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, rewritePath(r, prefix+r.URL.Path))
+	})
+}
+
+// MethodsHandler responds with `405 Method Not Allowed`, and an Allow header
+// listing the permitted methods, to requests using any other method.
+func MethodsHandler(h http.Handler, methods []string) http.Handler {
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})
+}
+
+// DenyDotfilesHandler responds with `403 Forbidden` to requests for paths
+// with any segment beginning with ".", such as `/.env` or `/sub/.git/config`,
+// without passing them on to h.
+func DenyDotfilesHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, segment := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(segment, ".") {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// MessageHandler responds to every request with the given status and plain
+// text message.
+func MessageHandler(status int, msg string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		io.WriteString(w, msg)
+	})
+}
+
+// StatusHandler responds to every request with the given status and, if body
+// is set and the status allows one, its text as a plain text body.
+func StatusHandler(status int, body bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body && bodyAllowed(status) {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		if bodyAllowed(status) {
+			w.Header().Set("Content-Length", "0")
+		}
+		w.WriteHeader(status)
+	})
+}
+
+// addVary adds field to the Vary header unless it's already listed.
+func addVary(h http.Header, field string) {
+	for _, v := range h["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
+
+// FallbackHandler serves the fallback file within dir, with status 200, for
+// requests for HTML pages that don't exist within dir. This allows single-page
+// apps to handle routing client-side. Requests for missing files with an
+// extension (such as scripts and stylesheets) are passed through so that
+// they fail normally.
+func FallbackHandler(h http.Handler, dir http.FileSystem, fallback string) http.Handler {
+	fallback = path.Clean("/" + fallback)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ext := path.Ext(r.URL.Path)
+		if (ext == "" || ext == ".html" || ext == ".htm") && acceptsHTML(r) &&
+			!exists(dir, r.URL.Path) {
+			// Served directly, as the file server would redirect requests
+			// for index.html, and reject paths containing ".."
+			f, err := dir.Open(fallback)
+			if err != nil {
+				log.Printf("Couldn't open fallback %s: %s\n", fallback, err)
+				h.ServeHTTP(w, r)
+				return
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil || fi.IsDir() {
+				h.ServeHTTP(w, r)
+				return
+			}
+			http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// IndexFilesHandler serves the first of the named index files that exists
+// within a requested directory, by internally rewriting the request's path.
+// Directories containing none of them are passed on to h unchanged, to be
+// listed (or not) as usual.
+func IndexFilesHandler(h http.Handler, dir http.FileSystem, names []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if p == "" || strings.HasSuffix(p, "/") {
+			for _, name := range names {
+				if !isFile(dir, path.Join("/", p, name)) {
+					continue
+				}
+				// The file server redirects explicit requests for index.html
+				// back to the directory, but serves it for the directory
+				if name != "index.html" {
+					r = rewritePath(r, p+name)
+				}
+				break
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// TrailingSlashHandler redirects requests to the canonical form of their
+// path with `301 Moved Permanently`, either adding a trailing slash (if mode
+// is "add") or stripping it (if mode is "strip"). Paths of files within dir
+// are never given a trailing slash, and paths of directories never have theirs
+// stripped, as the file server would only redirect them back again. An empty
+// path is the root of dir, requested without a trailing slash, so is given
+// one in "add" mode.
+func TrailingSlashHandler(h http.Handler, dir http.FileSystem, mode string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		var target string
+		switch {
+		case p == "":
+			if orig := requestPath(r); mode == "add" && !strings.HasSuffix(orig, "/") {
+				target = path.Base(orig) + "/"
+			}
+		case p == "/":
+		case mode == "add" && !strings.HasSuffix(p, "/") && !isFile(dir, p):
+			target = path.Base(p) + "/"
+		case mode == "strip" && strings.HasSuffix(p, "/") && !isDir(dir, p):
+			target = "../" + path.Base(p)
+		}
+		if target == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Redirect relative to the request, like http.FileServer, as the
+		// serve's prefix has been stripped from the path
+		target = (&url.URL{Path: target}).String()
+		w.Header().Set("Location", withQuery(target, r.URL.RawQuery))
+		w.WriteHeader(http.StatusMovedPermanently)
+	})
+}
+
+// requestPath returns the path originally requested by the client, before
+// any prefix was stripped from it.
+func requestPath(r *http.Request) string {
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		return u.Path
+	}
+	return r.URL.Path
+}
+
+// acceptsHTML returns true if the client will accept an HTML response.
+func acceptsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/html") || strings.Contains(accept, "*/*")
+}
+
+// exists returns true if name can be opened within fs.
+func exists(fs http.FileSystem, name string) bool {
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// isFile returns true if name is a regular file within fs.
+func isFile(fs http.FileSystem, name string) bool {
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// isDir returns true if name is a directory within fs.
+func isDir(fs http.FileSystem, name string) bool {
+	f, err := fs.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	return err == nil && fi.IsDir()
+}
+
+// rewritePath returns a shallow copy of r with its URL path replaced.
+func rewritePath(r *http.Request, p string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = p
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// MaxRequestBodyHandler rejects requests with bodies larger than limit bytes
+// with `413 Request Entity Too Large`. Bodies of unknown length are cut off
+// at the limit as they're read.
+func MaxRequestBodyHandler(h http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > limit {
+			w.Header().Set("Connection", "close")
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// MaxConnectionsHandler handles at most limit requests at once, rejecting
+// any more with `503 Service Unavailable` rather than queueing them.
+func MaxConnectionsHandler(h http.Handler, limit int) http.Handler {
+	slots := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			h.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// DrainingHandler responds to requests with `503 Service Unavailable`, asking
+// clients to retry shortly and to close the connection, while draining
+// returns true. Otherwise requests are passed on to h.
+func DrainingHandler(h http.Handler, draining func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining() {
+			w.Header().Set("Retry-After", "1")
+			w.Header().Set("Connection", "close")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// MaintenanceHandler responds to requests with `503 Service Unavailable`,
+// served by unavailable, whenever the file named by sentinel exists, so that
+// maintenance mode can be switched on and off by creating and removing it.
+// Requests for paths beginning with any of allow are passed on to h as
+// usual, as are all requests while the file doesn't exist.
+func MaintenanceHandler(h http.Handler, sentinel string, allow []string, unavailable http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := os.Stat(sentinel); err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		for _, prefix := range allow {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		unavailable.ServeHTTP(w, r)
+	})
+}
+
+// MaintenancePageHandler serves the file named by page, in full, with the
+// status `503 Service Unavailable`.
+func MaintenancePageHandler(page string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Serve the whole page, rather than a range or "not modified"
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.Header = r.Header.Clone()
+		for _, name := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+			r2.Header.Del(name)
+		}
+		http.ServeFile(statusResponseWriter{w, http.StatusServiceUnavailable}, r2, page)
+	})
+}
+
+// QueryRedirectHandler redirects all requests to target, like
+// http.RedirectHandler, but appends the request's query string to it.
+func QueryRedirectHandler(target string, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, withQuery(target, r.URL.RawQuery), status)
+	})
+}
+
+// PatternRedirectHandler redirects requests with paths matching re to the
+// target produced by expanding `$1`, `${name}` etc. in to with the
+// corresponding submatches. If preserveQuery is true, the request's query
+// string is appended to the target.
+func PatternRedirectHandler(re *regexp.Regexp, to string, status int, preserveQuery bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		match := re.FindStringSubmatchIndex(r.URL.Path)
+		if match == nil {
+			http.NotFound(w, r)
+			return
+		}
+		target := string(re.ExpandString(nil, to, r.URL.Path, match))
+		if preserveQuery {
+			target = withQuery(target, r.URL.RawQuery)
+		}
+		http.Redirect(w, r, target, status)
+	})
+}
+
+// HTTPSRedirectHandler permanently redirects requests to the same host, path
+// and query over HTTPS. If port is non-zero, it is used in place of the
+// default HTTPS port.
+func HTTPSRedirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// No port, but IPv6 addresses are still bracketed
+			host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+		}
+		if port != 0 && port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
+
+// withQuery appends query to the target URL, after any query it already has.
+func withQuery(target, query string) string {
+	if query == "" {
+		return target
+	}
+	fragment := ""
+	if i := strings.Index(target, "#"); i >= 0 {
+		target, fragment = target[:i], target[i:]
+	}
+	if !strings.Contains(target, "?") {
+		target += "?"
+	} else if !strings.HasSuffix(target, "?") && !strings.HasSuffix(target, "&") {
+		target += "&"
+	}
+	return target + query + fragment
+}
+
+// CannedResponse is a complete HTTP response that is replayed verbatim.
+type CannedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// ReadCannedResponse reads a response from a file containing a status line
+// (e.g. `HTTP/1.1 200 OK`), a block of headers, a blank line and the body,
+// as it would be sent over the wire.
+func ReadCannedResponse(filename string) (*CannedResponse, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	resp, err := http.ReadResponse(bufio.NewReader(f), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &CannedResponse{
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   body,
+	}, nil
+}
+
+// ServeHTTP writes the canned response. Error statuses are sent as they are,
+// rather than replaced by the configured error pages.
+func (c *CannedResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	GetRequestInfo(r).Verbatim = true
+	wh := w.Header()
+	for k, v := range c.Header {
+		wh[k] = v
+	}
+	w.WriteHeader(c.Status)
+	if r.Method != "HEAD" {
+		w.Write(c.Body)
+	}
+}
+
+// HeaderHookResponseWriter calls a hook immediately before the response
+// header is written, allowing headers set by the wrapped handler to be amended.
+type HeaderHookResponseWriter struct {
+	http.ResponseWriter
+	hook        func(h http.Header, status int)
+	wroteHeader bool
+}
+
+func (w *HeaderHookResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.hook(w.Header(), status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *HeaderHookResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ServerHeaderHandler sets the Server response header to value, unless the
+// wrapped handler has set one itself.
+func ServerHeaderHandler(h http.Handler, value string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&HeaderHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(wh http.Header, status int) {
+				if wh.Get("Server") == "" {
+					wh.Set("Server", value)
+				}
+			},
+		}, r)
+	})
+}
+
+// DefaultContentTypeHandler replaces the generic `application/octet-stream`
+// content type with contentType, for files with no known extension.
+func DefaultContentTypeHandler(h http.Handler, contentType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Leave types derived from the extension alone
+		if mime.TypeByExtension(path.Ext(r.URL.Path)) != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(&HeaderHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(wh http.Header, status int) {
+				if wh.Get("Content-Type") == "application/octet-stream" {
+					wh.Set("Content-Type", contentType)
+				}
+			},
+		}, r)
+	})
+}
+
+// MIMETypesHandler sets the content type of successful responses for files
+// whose extensions are in types, overriding the type the file server would
+// otherwise derive from the extension or content.
+func MIMETypesHandler(h http.Handler, types map[string]string) http.Handler {
+	byExt := make(map[string]string, len(types))
+	for ext, contentType := range types {
+		byExt[strings.ToLower(ext)] = contentType
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType, found := byExt[strings.ToLower(path.Ext(r.URL.Path))]
+		if !found {
+			h.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(&HeaderHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(wh http.Header, status int) {
+				if status < 300 {
+					wh.Set("Content-Type", contentType)
+				}
+			},
+		}, r)
+	})
+}
+
+// DefaultCharsetHandler adds the given charset to text content types that
+// don't specify one.
+func DefaultCharsetHandler(h http.Handler, charset string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&HeaderHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(wh http.Header, status int) {
+				contentType := wh.Get("Content-Type")
+				mediaType, params, err := mime.ParseMediaType(contentType)
+				if err == nil && strings.HasPrefix(mediaType, "text/") && params["charset"] == "" {
+					wh.Set("Content-Type", contentType+"; charset="+charset)
+				}
+			},
+		}, r)
+	})
+}
+
+// ForceDownloadHandler sets `Content-Disposition: attachment` on successful
+// responses for files with the given extensions (or all files, given "*"),
+// so that browsers download them rather than displaying them. The file name
+// suggested is that of the requested file.
+func ForceDownloadHandler(h http.Handler, exts []string) http.Handler {
+	all := false
+	match := make(map[string]bool)
+	for _, ext := range exts {
+		if ext == "*" {
+			all = true
+		}
+		match[strings.ToLower(ext)] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Base(r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") || !(all || match[strings.ToLower(path.Ext(name))]) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Quoted, or encoded as per RFC 2231 if not plain ASCII
+		disposition := mime.FormatMediaType("attachment", map[string]string{"filename": name})
+		if disposition == "" {
+			disposition = "attachment" // the name can't be represented
+		}
+		h.ServeHTTP(&HeaderHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(wh http.Header, status int) {
+				if status == http.StatusOK || status == http.StatusPartialContent {
+					wh.Set("Content-Disposition", disposition)
+				}
+			},
+		}, r)
+	})
+}
+
+// DisableRangesHandler removes Range headers from requests, so that files
+// are always served in full, and tells clients so with `Accept-Ranges: none`.
+func DisableRangesHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" || r.Header.Get("If-Range") != "" {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.Header = r.Header.Clone()
+			r2.Header.Del("Range")
+			r2.Header.Del("If-Range")
+			r = r2
+		}
+		h.ServeHTTP(&HeaderHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(wh http.Header, status int) {
+				wh.Set("Accept-Ranges", "none")
+			},
+		}, r)
+	})
+}
+
+// bodyAllowed returns true if responses with the given status may have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// bufferResponseWriter holds back a response until it's complete, or until
+// more than limit bytes of it have been written, whereupon it's passed
+// through as it's written.
+type bufferResponseWriter struct {
+	http.ResponseWriter
+	limit   int64
+	buf     bytes.Buffer
+	status  int
+	flushed bool // whether the limit was exceeded and the response passed through
+}
+
+func (w *bufferResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *bufferResponseWriter) Write(b []byte) (int, error) {
+	if w.flushed {
+		return w.ResponseWriter.Write(b)
+	}
+	if int64(w.buf.Len()+len(b)) <= w.limit {
+		return w.buf.Write(b)
+	}
+	w.flushed = true
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if _, err := w.buf.WriteTo(w.ResponseWriter); err != nil {
+		return 0, err
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish writes out a buffered response, along with its length.
+func (w *bufferResponseWriter) finish(r *http.Request) {
+	if w.flushed || w.status == 0 && w.buf.Len() == 0 {
+		return
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	// Handlers needn't write a body for HEAD requests, in which case there's
+	// nothing to measure, so whatever length they gave is kept
+	if bodyAllowed(w.status) && (r.Method != "HEAD" || w.buf.Len() > 0) {
+		w.Header().Set("Content-Length", strconv.Itoa(w.buf.Len()))
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.buf.WriteTo(w.ResponseWriter)
+}
+
+// BufferHandler buffers responses of up to limit bytes in full, so that they
+// can be sent with a Content-Length rather than chunked, as generated
+// responses such as directory listings otherwise would be. Larger responses
+// are passed through once they exceed the limit.
+func BufferHandler(h http.Handler, limit int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bw := &bufferResponseWriter{ResponseWriter: w, limit: limit}
+		h.ServeHTTP(bw, r)
+		bw.finish(r)
+	})
+}
+
+// PreloadHandler adds the given Link header values to successful HTML
+// responses, so that browsers start fetching the resources they name before
+// finding them in the page itself.
+func PreloadHandler(h http.Handler, links []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&HeaderHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(wh http.Header, status int) {
+				mediaType, _, _ := mime.ParseMediaType(wh.Get("Content-Type"))
+				if status == http.StatusOK && mediaType == "text/html" {
+					for _, link := range links {
+						wh.Add("Link", link)
+					}
+				}
+			},
+		}, r)
+	})
+}
+
+// streamBufferPool holds the buffers used to copy streamed responses.
+var streamBufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 128*1024)
+	},
+}
+
+// StreamResponseWriter copies content read from files to the client using
+// pooled buffers, rather than allocating a buffer for every response.
+type StreamResponseWriter struct {
+	http.ResponseWriter
+}
+
+// ReadFrom copies from src to the response using a pooled buffer.
+func (w StreamResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	buf := streamBufferPool.Get().([]byte)
+	defer streamBufferPool.Put(buf)
+	// Hide ReadFrom from io.CopyBuffer so it doesn't recurse
+	return io.CopyBuffer(struct{ io.Writer }{w.ResponseWriter}, src, buf)
+}
+
+// StreamHandler serves responses through a StreamResponseWriter.
+func StreamHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(StreamResponseWriter{w}, r)
+	})
+}
+
 // CustomHeadersHandler creates a new handler that includes the provided
-// headers in each response.
+// headers in each response, unless already set by an outer handler. Inner
+// handlers, such as the file server, may replace them.
 func CustomHeadersHandler(h http.Handler, headers Headers) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		wh := w.Header()
@@ -157,36 +1179,397 @@ func CustomHeadersHandler(h http.Handler, headers Headers) http.Handler {
 	})
 }
 
-// GzipResponseWriter gzips content written to it
-type GzipResponseWriter struct {
-	io.Writer
+// ForceHeadersHandler sets the provided headers on each response, replacing
+// any values set by the wrapped handler.
+func ForceHeadersHandler(h http.Handler, headers Headers) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&HeaderHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(wh http.Header, status int) {
+				for k, v := range headers {
+					wh.Set(k, v)
+				}
+			},
+		}, r)
+	})
+}
+
+// RemoveHeadersHandler removes the named headers from responses, including
+// any set by the wrapped handler.
+func RemoveHeadersHandler(h http.Handler, names []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(&HeaderHookResponseWriter{
+			ResponseWriter: w,
+			hook: func(wh http.Header, status int) {
+				for _, name := range names {
+					wh.Del(name)
+				}
+			},
+		}, r)
+	})
+}
+
+// GzipOptions tunes response compression. Zero values defer to the defaults
+// (or, for a serve, to the listener's options). The level only applies to
+// gzip; other options apply to all content codings.
+type GzipOptions struct {
+	Level     int      `yaml:"gzip-level,omitempty"`      // compression level (1-9, or 0 for the default)
+	MinLength int      `yaml:"gzip-min-length,omitempty"` // don't compress smaller responses
+	SkipTypes []string `yaml:"gzip-skip-types,omitempty"` // content types to never compress
+}
+
+// defaultGzipOptions are used where a listener doesn't specify otherwise. By
+// default, content types that are already compressed are skipped.
+var defaultGzipOptions = GzipOptions{
+	SkipTypes: []string{
+		"image/gif", "image/jpeg", "image/png", "image/webp",
+		"audio/*", "video/*", "font/woff", "font/woff2",
+		"application/gzip", "application/x-gzip", "application/zip",
+		"application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+		"application/x-rar-compressed",
+	},
+}
+
+// merge returns the options with any set in override taking precedence.
+func (o GzipOptions) merge(override GzipOptions) GzipOptions {
+	if override.Level != 0 {
+		o.Level = override.Level
+	}
+	if override.MinLength != 0 {
+		o.MinLength = override.MinLength
+	}
+	if override.SkipTypes != nil {
+		o.SkipTypes = override.SkipTypes
+	}
+	return o
+}
+
+func (o GzipOptions) check(label string) (ok bool) {
+	ok = true
+	if o.Level < 0 || o.Level > gzip.BestCompression {
+		log.Printf(label+": gzip level %d not in range 1-9 (or 0 for the default)", o.Level)
+		ok = false
+	}
+	if o.MinLength < 0 {
+		log.Printf(label+": negative gzip min length %d", o.MinLength)
+		ok = false
+	}
+	return
+}
+
+// skips returns true if responses of the given content type should not be
+// compressed. Skip types may be exact (`image/png`) or wildcards (`image/*`).
+func (o GzipOptions) skips(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	for _, t := range o.SkipTypes {
+		if t == mediaType ||
+			strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// encoders maps the supported content codings to constructors for writers
+// that encode content written to them.
+var encoders = map[string]func(w io.Writer, opts GzipOptions) io.WriteCloser{
+	"gzip": func(w io.Writer, opts GzipOptions) io.WriteCloser {
+		level := opts.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		gz, _ := gzip.NewWriterLevel(w, level)
+		return gz
+	},
+	"br": func(w io.Writer, opts GzipOptions) io.WriteCloser {
+		return brotli.NewWriter(w)
+	},
+}
+
+// negotiateEncoding returns the content coding from encodings most preferred
+// by the given `Accept-Encoding` header, or an empty string if none are
+// acceptable. Codings with equal weight are preferred in the client's order.
+func negotiateEncoding(acceptEncoding string, encodings []string) (encoding string) {
+	best := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= best {
+			continue
+		}
+		for _, e := range encodings {
+			if e == name {
+				encoding, best = e, q
+			}
+		}
+	}
+	return
+}
+
+// detectContentType sets the Content-Type header from the first block of
+// content written, if the handler hasn't set it already.
+func detectContentType(h http.Header, b []byte) {
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(b))
+	}
+}
+
+// CompressResponseWriter compresses content written to it. Output is buffered
+// until enough has been written to decide whether compression is worthwhile.
+type CompressResponseWriter struct {
 	http.ResponseWriter
-	gotContentType bool
+	r        *http.Request
+	encoding string // content coding, e.g. "gzip"
+	opts     GzipOptions
+	enc      io.WriteCloser
+	out      *encodedOutput
+	buf      []byte
+	status   int
+	decided  bool
+	compress bool
+	err      error // first error from the encoder
 }
 
-func (w *GzipResponseWriter) Write(b []byte) (int, error) {
-	if !w.gotContentType {
-		if w.Header().Get("Content-Type") == "" {
-			w.Header().Set("Content-Type", http.DetectContentType(b))
+// encodedOutput passes encoded content on to the response, writing the
+// response header first. Until then, the header can still be changed to
+// send the content uncompressed instead. For serves that buffer responses,
+// encoded content is held back, up to the serve's limit, so that its length
+// can be sent.
+type encodedOutput struct {
+	w     *CompressResponseWriter
+	sent  bool // whether the header has been written
+	limit int64
+	buf   []byte
+}
+
+func (o *encodedOutput) Write(b []byte) (int, error) {
+	if !o.sent {
+		if int64(len(o.buf)+len(b)) <= o.limit {
+			o.buf = append(o.buf, b...)
+			return len(b), nil
+		}
+		o.sent = true
+		o.w.writeHeader()
+		if len(o.buf) > 0 {
+			if _, err := o.w.ResponseWriter.Write(o.buf); err != nil {
+				return 0, err
+			}
+			o.buf = nil
 		}
-		w.gotContentType = true
 	}
-	return w.Writer.Write(b)
+	return o.w.ResponseWriter.Write(b)
 }
 
-// GzipHandler gzips the HTTP response if supported by the client. Based on
-// the implementation of `go.httpgzip`
-func GzipHandler(h http.Handler) http.Handler {
+// finish writes out any encoded content still held back, along with its
+// length.
+func (o *encodedOutput) finish() {
+	if o.sent || o.limit == 0 {
+		return
+	}
+	o.sent = true
+	if bodyAllowed(o.w.status) || o.w.status == 0 {
+		o.w.Header().Set("Content-Length", strconv.Itoa(len(o.buf)))
+	}
+	o.w.writeHeader()
+	o.w.ResponseWriter.Write(o.buf)
+	o.buf = nil
+}
+
+// WriteHeader defers writing the status until the response body has been
+// inspected.
+func (w *CompressResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *CompressResponseWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		detectContentType(w.Header(), b)
+		if !w.compressible() {
+			w.decide(false)
+		} else if w.buf = append(w.buf, b...); len(w.buf) < w.opts.MinLength {
+			return len(b), nil
+		} else {
+			w.decide(true)
+		}
+		if err := w.flush(); err != nil {
+			return 0, err
+		}
+		if w.buf != nil {
+			// b was buffered and has now been written
+			w.buf = nil
+			return len(b), nil
+		}
+	}
+	if w.compress {
+		n, err := w.enc.Write(b)
+		if err != nil {
+			w.fail(err)
+		}
+		return n, err
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// compressible returns false if the response mustn't be compressed, however
+// long it is. The matched serve's options are resolved first, as the serve is
+// only known once the request has been routed.
+func (w *CompressResponseWriter) compressible() bool {
+	serve := GetRequestInfo(w.r).Serve
+	w.opts = w.opts.merge(serve.gzipOptions())
+	return !(serve != nil && serve.Stream || w.Header().Get("Content-Encoding") != "" ||
+		w.opts.skips(w.Header().Get("Content-Type")))
+}
+
+// decideHead decides whether a response to a HEAD request, which has no
+// body, would be compressed if it were a GET, going by its Content-Length.
+func (w *CompressResponseWriter) decideHead() bool {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if !bodyAllowed(status) || !w.compressible() {
+		return false
+	}
+	if cl := w.Header().Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil && (n == 0 || n < int64(w.opts.MinLength)) {
+			return false
+		}
+	}
+	return true
+}
+
+// decide sets whether the response will be compressed. If not, the response
+// header is written; otherwise it's written along with the first compressed
+// output.
+func (w *CompressResponseWriter) decide(compress bool) {
+	w.decided = true
+	w.compress = compress
+	if !compress {
+		w.writeHeader()
+		return
+	}
+	// Any Content-Length set by the handler is for the uncompressed
+	// content, so remove it and fall back to chunked encoding
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", w.encoding)
+	w.out = &encodedOutput{w: w, limit: GetRequestInfo(w.r).Serve.bufferSize()}
+	w.enc = encoders[w.encoding](w.out, w.opts)
+}
+
+// writeHeader writes the status given by the handler, if any.
+func (w *CompressResponseWriter) writeHeader() {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// fail records and logs an error from the encoder.
+func (w *CompressResponseWriter) fail(err error) {
+	if w.err == nil {
+		w.err = err
+		log.Printf("Couldn't compress %s with %s: %s\n", w.r.URL.Path, w.encoding, err)
+	}
+}
+
+// flush writes out any buffered content. If the encoder fails without having
+// written anything, the content is written uncompressed instead.
+func (w *CompressResponseWriter) flush() (err error) {
+	if len(w.buf) == 0 {
+		return
+	}
+	if !w.compress {
+		_, err = w.ResponseWriter.Write(w.buf)
+		return
+	}
+	if _, err = w.enc.Write(w.buf); err == nil {
+		return
+	}
+	if w.out.sent {
+		w.fail(err)
+		return
+	}
+	log.Printf("Couldn't compress %s with %s, sending it uncompressed: %s\n", w.r.URL.Path, w.encoding, err)
+	w.compress = false
+	w.out.buf = nil
+	w.Header().Del("Content-Encoding")
+	w.writeHeader()
+	_, err = w.ResponseWriter.Write(w.buf)
+	return
+}
+
+// Close completes the response, writing it uncompressed if too little was
+// written to be worth compressing. Responses to HEAD requests get the headers
+// that a GET would. If compression failed part way through,
+// the client would otherwise receive a truncated body that appears complete,
+// so the connection is aborted (by panicking with http.ErrAbortHandler).
+func (w *CompressResponseWriter) Close() error {
+	if !w.decided && w.r.Method == "HEAD" && w.decideHead() {
+		// Send the same headers as for a GET, without a body
+		w.decided = true
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", w.encoding)
+		w.writeHeader()
+		return nil
+	}
+	if !w.decided {
+		w.decide(false)
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	if !w.compress {
+		return nil
+	}
+	if err := w.enc.Close(); err != nil {
+		w.fail(err)
+	}
+	w.out.finish()
+	if w.err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// CompressHandler compresses the HTTP response using whichever of the given
+// content codings ("gzip" and/or "br") is most preferred by the client.
+// Range requests are never compressed, as byte ranges refer to the
+// uncompressed content; they're left for the file server to satisfy.
+func CompressHandler(h http.Handler, encodings []string, opts GzipOptions) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Serve normally to clients that don't express gzip support
-		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		addVary(w.Header(), "Accept-Encoding")
+
+		// Serve normally to clients that don't accept any of the encodings
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), encodings)
+		if encoding == "" || r.Header.Get("Range") != "" {
 			h.ServeHTTP(w, r)
 			return
 		}
 
-		w.Header().Set("Content-Encoding", "gzip")
-		gz := gzip.NewWriter(w)
-		defer gz.Close()
-		h.ServeHTTP(&GzipResponseWriter{Writer: gz, ResponseWriter: w}, r)
+		cw := &CompressResponseWriter{ResponseWriter: w, r: r, encoding: encoding, opts: opts}
+		defer cw.Close()
+		h.ServeHTTP(cw, r)
 	})
 }
+
+// GzipHandler gzips the HTTP response if supported by the client. Based on
+// the implementation of `go.httpgzip`
+func GzipHandler(h http.Handler, opts GzipOptions) http.Handler {
+	return CompressHandler(h, []string{"gzip"}, opts)
+}
+
+// BrotliHandler compresses the HTTP response with Brotli if supported by the
+// client.
+func BrotliHandler(h http.Handler, opts GzipOptions) http.Handler {
+	return CompressHandler(h, []string{"br"}, opts)
+}
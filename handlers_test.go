@@ -0,0 +1,871 @@
+package goserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// gzipString returns s compressed with gzip.
+func gzipString(s string) string {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.String()
+}
+
+// gunzip returns the decompressed content of b.
+func gunzip(t *testing.T, b []byte) string {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestPrecompressedRange(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	dir := writeFiles(t, map[string]string{
+		"app.js":    content,
+		"app.js.gz": gzipString(content),
+	})
+	h := testHandler(t, ServerConfig{Serves: []Serve{{Path: "/", Target: dir, Precompressed: true}}})
+
+	w := get(h, "GET", "/app.js", "Accept-Encoding", "gzip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got %d, Content-Encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if got := gunzip(t, w.Body.Bytes()); got != content {
+		t.Errorf("got body %.20q...", got)
+	}
+
+	// Ranges apply to the uncompressed file
+	w = get(h, "GET", "/app.js", "Accept-Encoding", "gzip", "Range", "bytes=10-19")
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("got %d, Content-Encoding %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 10-19/1000" {
+		t.Errorf("got Content-Range %q", got)
+	}
+	if got := w.Body.String(); got != "0123456789" {
+		t.Errorf("got body %q", got)
+	}
+}
+
+func TestCompressRange(t *testing.T) {
+	content := strings.Repeat("0123456789", 100)
+	dir := writeFiles(t, map[string]string{"a.txt": content})
+	h := testHandler(t, ServerConfig{
+		Listeners: []Listener{{Protocol: "http", Addr: "127.0.0.1:0", Gzip: true}},
+		Serves:    []Serve{{Path: "/", Target: dir}},
+	})
+	w := get(h, "GET", "/a.txt", "Accept-Encoding", "gzip", "Range", "bytes=0-99")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("got status %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("got Content-Encoding %q", got)
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 0-99/1000" {
+		t.Errorf("got Content-Range %q", got)
+	}
+	if got := w.Body.String(); got != content[:100] {
+		t.Errorf("got body %q", got)
+	}
+}
+
+func TestCompressHead(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"big.txt":   strings.Repeat("a", 2000),
+		"small.txt": "a",
+		"image.png": "\x89PNG\r\n\x1a\n" + strings.Repeat("a", 2000),
+	})
+	h := testHandler(t, ServerConfig{
+		Listeners: []Listener{{Protocol: "http", Addr: "127.0.0.1:0", Gzip: true,
+			GzipOptions: GzipOptions{MinLength: 100}}},
+		Serves: []Serve{{Path: "/", Target: dir}},
+	})
+	for _, p := range []string{"/big.txt", "/small.txt", "/image.png"} {
+		getW := get(h, "GET", p, "Accept-Encoding", "gzip")
+		headW := get(h, "HEAD", p, "Accept-Encoding", "gzip")
+		for _, name := range []string{"Content-Encoding", "Content-Length", "Content-Type"} {
+			if g, h := getW.Header().Get(name), headW.Header().Get(name); g != h {
+				t.Errorf("%s: GET has %s %q, HEAD has %q", p, name, g, h)
+			}
+		}
+		if compressed := p == "/big.txt"; (headW.Header().Get("Content-Encoding") == "gzip") != compressed {
+			t.Errorf("%s: HEAD has Content-Encoding %q", p, headW.Header().Get("Content-Encoding"))
+		}
+		if headW.Body.Len() != 0 {
+			t.Errorf("%s: HEAD has a body", p)
+		}
+	}
+}
+
+func TestCompressContentLength(t *testing.T) {
+	content := strings.Repeat("hello, world\n", 200)
+	dir := writeFiles(t, map[string]string{"a.txt": content})
+	h := testHandler(t, ServerConfig{
+		Listeners: []Listener{{Protocol: "http", Addr: "127.0.0.1:0", Gzip: true}},
+		Serves:    []Serve{{Path: "/", Target: dir}},
+	})
+	w := get(h, "GET", "/a.txt", "Accept-Encoding", "gzip")
+	if got := w.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q", got)
+	}
+	if got := w.Header().Get("Content-Length"); got != "" {
+		t.Errorf("got stale Content-Length %s", got)
+	}
+	if got := gunzip(t, w.Body.Bytes()); got != content {
+		t.Errorf("body decompressed to %.20q...", got)
+	}
+}
+
+func TestDenyDotfiles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		".env":            "SECRET=1",
+		"sub/.git/config": "[core]",
+		"sub/a.txt":       "a",
+	})
+	h := testHandler(t, ServerConfig{Serves: []Serve{{Path: "/", Target: dir, DenyDotfiles: true}}})
+	for _, c := range []struct {
+		path   string
+		status int
+	}{
+		{"/.env", http.StatusForbidden},
+		{"/sub/.git/config", http.StatusForbidden},
+		{"/%2eenv", http.StatusForbidden},
+		{"/sub/%2Egit/config", http.StatusForbidden},
+		{"/sub/a.txt", http.StatusOK},
+	} {
+		w := get(h, "GET", c.path)
+		if w.Code != c.status {
+			t.Errorf("%s: got status %d, want %d", c.path, w.Code, c.status)
+		}
+		if w.Code == http.StatusForbidden && strings.Contains(w.Body.String(), "SECRET") {
+			t.Errorf("%s: file content served", c.path)
+		}
+	}
+}
+
+// limitedWriter writes at most n bytes to w, then fails.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if len(b) > l.n {
+		n, _ := l.w.Write(b[:l.n])
+		l.n = 0
+		return n, errors.New("write failed")
+	}
+	l.n -= len(b)
+	return l.w.Write(b)
+}
+
+func (l *limitedWriter) Close() error {
+	return nil
+}
+
+// limitedResponseWriter is a ResponseWriter whose body fails after n bytes.
+type limitedResponseWriter struct {
+	*httptest.ResponseRecorder
+	lw *limitedWriter
+}
+
+func (w limitedResponseWriter) Write(b []byte) (int, error) {
+	return w.lw.Write(b)
+}
+
+func TestCompressEncoderFails(t *testing.T) {
+	// An encoder that fails straight away, before anything's been sent
+	encoders["failing"] = func(w io.Writer, opts GzipOptions) io.WriteCloser {
+		return &limitedWriter{w: w, n: 0}
+	}
+	defer delete(encoders, "failing")
+	h := CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}), []string{"failing"}, defaultGzipOptions)
+
+	w := get(h, "GET", "/", "Accept-Encoding", "failing")
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("got Content-Encoding %q", got)
+	}
+	if got := w.Body.String(); got != "hello" {
+		t.Errorf("got body %q, want it uncompressed", got)
+	}
+}
+
+func TestCompressWriterFails(t *testing.T) {
+	encoders["passthrough"] = func(w io.Writer, opts GzipOptions) io.WriteCloser {
+		return &limitedWriter{w: w, n: math.MaxInt32}
+	}
+	defer delete(encoders, "passthrough")
+	h := CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			w.Write(bytes.Repeat([]byte("a"), 100))
+		}
+	}), []string{"passthrough"}, defaultGzipOptions)
+
+	// The connection fails part way through the body, which must be aborted
+	// rather than appear complete
+	rec := httptest.NewRecorder()
+	w := limitedResponseWriter{rec, &limitedWriter{w: rec.Body, n: 150}}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "passthrough")
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("got panic %v, want http.ErrAbortHandler", p)
+		}
+		if rec.Body.Len() != 150 {
+			t.Errorf("wrote %d bytes", rec.Body.Len())
+		}
+	}()
+	h.ServeHTTP(w, r)
+}
+
+func TestMaxConnections(t *testing.T) {
+	const limit = 3
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	h := MaxConnectionsHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}), limit)
+
+	// Fill every slot with a request held at the barrier
+	var wg sync.WaitGroup
+	codes := make(chan int, limit)
+	for i := 0; i < limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- get(h, "GET", "/").Code
+		}()
+		<-entered
+	}
+
+	// Further requests, even concurrent ones, are rejected
+	var rejected sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		rejected.Add(1)
+		go func() {
+			defer rejected.Done()
+			w := get(h, "GET", "/")
+			if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+				t.Errorf("over the limit, got %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+			}
+		}()
+	}
+	rejected.Wait()
+
+	close(release)
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("within the limit, got %d", code)
+		}
+	}
+
+	// Slots are freed once requests complete
+	go func() { <-entered }()
+	if w := get(h, "GET", "/"); w.Code != http.StatusOK {
+		t.Errorf("after requests completed, got %d", w.Code)
+	}
+}
+
+// discardResponseWriter is a ResponseWriter that discards the body.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header         { return w.header }
+func (w discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardResponseWriter) WriteHeader(status int)      {}
+
+func BenchmarkStream(b *testing.B) {
+	const size = 16 << 20
+	dir := b.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "big.txt"), bytes.Repeat([]byte("0123456789abcdef\n"), size/17), 0644); err != nil {
+		b.Fatal(err)
+	}
+	s, err := NewServer(ServerConfig{
+		Listeners: []Listener{{Protocol: "http", Addr: "127.0.0.1:0", Gzip: true}},
+		Serves: []Serve{
+			{Path: "/default/", Target: dir},
+			{Path: "/stream/", Target: dir, Stream: true},
+		},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	h := s.servers[0].Handler
+	for _, name := range []string{"default", "stream"} {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r := httptest.NewRequest("GET", "/"+name+"/big.txt", nil)
+				r.Header.Set("Accept-Encoding", "gzip")
+				h.ServeHTTP(discardResponseWriter{make(http.Header)}, r)
+			}
+		})
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"index.html": "home"})
+	h := testHandler(t, ServerConfig{
+		Listeners: []Listener{{Protocol: "http", Addr: "127.0.0.1:0",
+			AllowedHosts: []string{"Example.com.", "*.example.org"}}},
+		Serves: []Serve{{Path: "/", Target: dir}},
+	})
+	for host, code := range map[string]int{
+		"example.com":      http.StatusOK,
+		"EXAMPLE.com:8080": http.StatusOK,
+		"example.com.":     http.StatusOK,
+		"www.example.org":  http.StatusOK,
+		"example.org":      http.StatusMisdirectedRequest,
+		"evil.com":         http.StatusMisdirectedRequest,
+		"example.com.evil": http.StatusMisdirectedRequest,
+		"wwwexample.org":   http.StatusMisdirectedRequest,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("%s: got %d, want %d", host, w.Code, code)
+		}
+	}
+}
+
+func TestServeGzipMinLength(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"short.txt": strings.Repeat("a", 1000),
+		"long.txt":  strings.Repeat("a", 3000),
+	})
+	h := testHandler(t, ServerConfig{
+		Listeners: []Listener{{Protocol: "http", Addr: "127.0.0.1:0", Gzip: true,
+			GzipOptions: GzipOptions{MinLength: 100}}},
+		Serves: []Serve{
+			{Path: "/", Target: dir},
+			{Path: "/strict/", Target: dir, StripPrefix: "/strict",
+				GzipOptions: GzipOptions{MinLength: 2000}},
+		},
+	})
+	for _, c := range []struct {
+		path string
+		gzip bool
+	}{
+		{"/short.txt", true},
+		{"/long.txt", true},
+		{"/strict/short.txt", false},
+		{"/strict/long.txt", true},
+	} {
+		w := get(h, "GET", c.path, "Accept-Encoding", "gzip")
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != c.gzip {
+			t.Errorf("%s: compressed %t, want %t", c.path, got, c.gzip)
+		}
+	}
+}
+
+func TestGzipOptionsCheck(t *testing.T) {
+	for level, ok := range map[int]bool{-1: false, 0: true, 1: true, 9: true, 10: false} {
+		if got := (GzipOptions{Level: level}).check("Listener"); got != ok {
+			t.Errorf("level %d: check returned %t", level, got)
+		}
+	}
+}
+
+func TestExtensionlessHTML(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"about.html":      "about",
+		"docs/index.html": "docs",
+		"data":            "data",
+	})
+	h := testHandler(t, ServerConfig{Serves: []Serve{{Path: "/", Target: dir, ExtensionlessHTML: true}}})
+	for _, c := range []struct {
+		path, body string
+	}{
+		{"/about", "about"},
+		{"/about.html", "about"},
+		{"/docs/", "docs"},
+		{"/data", "data"},
+	} {
+		w := get(h, "GET", c.path)
+		if w.Code != http.StatusOK || w.Body.String() != c.body {
+			t.Errorf("%s: got %d %q", c.path, w.Code, w.Body.String())
+		}
+	}
+	if w := get(h, "GET", "/about"); !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("got Content-Type %q", w.Header().Get("Content-Type"))
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"LICENSE":  "Permission is hereby granted",
+		"blob":     "\x00\x01\x02\x03",
+		"site.css": "body{}",
+	})
+	h := testHandler(t, ServerConfig{Serves: []Serve{{Path: "/", Target: dir,
+		DefaultContentType: "application/x-custom"}}})
+	for _, c := range []struct {
+		path, contentType string
+	}{
+		{"/LICENSE", "text/plain; charset=utf-8"}, // sniffed from its content
+		{"/blob", "application/x-custom"},
+		{"/site.css", "text/css; charset=utf-8"},
+	} {
+		if got := get(h, "GET", c.path).Header().Get("Content-Type"); got != c.contentType {
+			t.Errorf("%s: got Content-Type %q, want %q", c.path, got, c.contentType)
+		}
+	}
+}
+
+func TestMIMETypes(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"app.wasm":     "\x00asm",
+		"data.gstest":  "data",
+		"notes.txt":    "notes",
+		"sub/more.txt": "more",
+	})
+	h := testHandler(t, ServerConfig{
+		MIMETypes: map[string]string{".gstest": "application/x-goserve-test"},
+		Serves: []Serve{
+			{Path: "/", Target: dir},
+			{Path: "/sub/", Target: filepath.Join(dir, "sub"), StripPrefix: "/sub",
+				MIMETypes: map[string]string{".TXT": "text/x-notes"}},
+		},
+	})
+	for _, c := range []struct {
+		path, contentType string
+	}{
+		{"/app.wasm", "application/wasm"},
+		{"/data.gstest", "application/x-goserve-test"},
+		{"/notes.txt", "text/plain; charset=utf-8"},
+		{"/sub/more.txt", "text/x-notes"},
+	} {
+		if got := get(h, "GET", c.path).Header().Get("Content-Type"); got != c.contentType {
+			t.Errorf("%s: got Content-Type %q, want %q", c.path, got, c.contentType)
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.txt": "a"})
+	h := testHandler(t, ServerConfig{Serves: []Serve{
+		{Path: "/", Target: dir},
+		{Path: "/form/", Target: dir, StripPrefix: "/form", Methods: []string{"get", "post"}},
+		{Path: "/gone", Error: http.StatusGone},
+		{Path: "/ping", Status: http.StatusNoContent},
+		{Path: "/private", Error: http.StatusNotFound, Methods: []string{"GET"}},
+	}})
+	for _, c := range []struct {
+		method, target string
+		code           int
+		allow          string
+	}{
+		{"GET", "/a.txt", http.StatusOK, ""},
+		{"HEAD", "/a.txt", http.StatusOK, ""},
+		{"POST", "/a.txt", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"DELETE", "/a.txt", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"POST", "/form/a.txt", http.StatusOK, ""},
+		{"HEAD", "/form/a.txt", http.StatusMethodNotAllowed, "GET, POST"},
+		// Serves not serving files answer any method by default
+		{"POST", "/gone", http.StatusGone, ""},
+		{"DELETE", "/ping", http.StatusNoContent, ""},
+		{"POST", "/private", http.StatusMethodNotAllowed, "GET"},
+	} {
+		w := get(h, c.method, c.target)
+		if w.Code != c.code || w.Header().Get("Allow") != c.allow {
+			t.Errorf("%s %s: got %d with Allow %q", c.method, c.target, w.Code, w.Header().Get("Allow"))
+		}
+	}
+	if w := get(h, "HEAD", "/a.txt"); w.Body.Len() != 0 || w.Header().Get("Content-Length") != "1" {
+		t.Errorf("HEAD: got body %q, Content-Length %q", w.Body.String(), w.Header().Get("Content-Length"))
+	}
+}
+
+func TestDisableRanges(t *testing.T) {
+	content := strings.Repeat("0123456789", 20)
+	dir := writeFiles(t, map[string]string{"a.txt": content})
+	h := testHandler(t, ServerConfig{Serves: []Serve{
+		{Path: "/", Target: dir},
+		{Path: "/whole/", Target: dir, StripPrefix: "/whole", DisableRanges: true},
+	}})
+	if w := get(h, "GET", "/a.txt", "Range", "bytes=0-9"); w.Code != http.StatusPartialContent {
+		t.Errorf("with ranges, got %d", w.Code)
+	}
+	w := get(h, "GET", "/whole/a.txt", "Range", "bytes=0-9")
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Errorf("without ranges, got %d %.20q", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Accept-Ranges"); got == "bytes" {
+		t.Errorf("got Accept-Ranges %q", got)
+	}
+}
+
+func TestCannedResponseVerbatim(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"404.http": "HTTP/1.1 404 Not Found\r\nContent-Type: application/json\r\nX-Canned: 404\r\n\r\n{\"error\": \"not found\"}\n",
+		"503.http": "HTTP/1.1 503 Service Unavailable\r\nContent-Type: text/plain\r\nRetry-After: 30\r\n\r\ndown for maintenance\n",
+		"404.html": "<h1>Not found</h1>",
+		"503.html": "<h1>Unavailable</h1>",
+	})
+	h := testHandler(t, ServerConfig{
+		Serves: []Serve{
+			{Path: "/gone", Response: filepath.Join(dir, "404.http")},
+			{Path: "/down", Response: filepath.Join(dir, "503.http")},
+		},
+		Errors: []Error{
+			{Status: http.StatusNotFound, Target: filepath.Join(dir, "404.html")},
+			{Status: http.StatusServiceUnavailable, Target: filepath.Join(dir, "503.html")},
+		},
+	})
+	for _, c := range []struct {
+		path   string
+		status int
+		header map[string]string
+		body   string
+	}{
+		{"/gone", http.StatusNotFound, map[string]string{"Content-Type": "application/json", "X-Canned": "404"}, "{\"error\": \"not found\"}\n"},
+		{"/down", http.StatusServiceUnavailable, map[string]string{"Content-Type": "text/plain", "Retry-After": "30"}, "down for maintenance\n"},
+	} {
+		w := get(h, "GET", c.path)
+		if w.Code != c.status {
+			t.Errorf("%s: got %d", c.path, w.Code)
+		}
+		for k, v := range c.header {
+			if got := w.Header().Get(k); got != v {
+				t.Errorf("%s: got %s %q, want %q", c.path, k, got, v)
+			}
+		}
+		if got := w.Body.String(); got != c.body {
+			t.Errorf("%s: got body %q, want %q", c.path, got, c.body)
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"index.html":    "<div id=app></div>",
+		"assets/app.js": "app()",
+	})
+	h := testHandler(t, ServerConfig{Serves: []Serve{{Path: "/", Target: dir, Fallback: "index.html"}}})
+	for _, target := range []string{"/users/42/profile", "/users/42/", "/about.html"} {
+		w := get(h, "GET", target, "Accept", "text/html")
+		if w.Code != http.StatusOK || w.Body.String() != "<div id=app></div>" {
+			t.Errorf("%s: got %d %q", target, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+			t.Errorf("%s: got Content-Type %q", target, got)
+		}
+	}
+
+	// Paths that the file server would reject still get the fallback, should
+	// they get past the mux
+	r := httptest.NewRequest("GET", "/users/x/settings", nil)
+	r.URL.Path = "/users/../settings"
+	r.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	FallbackHandler(http.NotFoundHandler(), http.Dir(dir), "index.html").ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "<div id=app></div>" {
+		t.Errorf("path with ..: got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := get(h, "GET", "/assets/app.js"); w.Body.String() != "app()" {
+		t.Errorf("existing file: got %d %q", w.Code, w.Body.String())
+	}
+	if w := get(h, "GET", "/assets/missing.js", "Accept", "*/*"); w.Code == http.StatusOK {
+		t.Errorf("missing asset: got %d %q", w.Code, w.Body.String())
+	}
+	if w := get(h, "GET", "/users/42", "Accept", "application/json"); w.Code == http.StatusOK {
+		t.Errorf("non-HTML request: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestRedirectPreserveQuery(t *testing.T) {
+	h := testHandler(t, ServerConfig{
+		Serves: []Serve{{Path: "/new", Status: http.StatusNoContent}},
+		Redirects: []Redirect{
+			{From: "/old", To: "/new", PreserveQuery: true},
+			{From: "/search", To: "/find?lang=en#results", PreserveQuery: true},
+			{From: "/dropped", To: "/new"},
+			{From: "^/posts/([0-9]+)$", To: "/articles/$1?src=posts", Regex: true, PreserveQuery: true},
+		},
+	})
+	for _, c := range []struct {
+		target, location string
+	}{
+		{"/old", "/new"},
+		{"/old?x=1&y=2", "/new?x=1&y=2"},
+		{"/search?q=go", "/find?lang=en&q=go#results"},
+		{"/search", "/find?lang=en#results"},
+		{"/dropped?x=1", "/new"},
+		{"/posts/7?page=2", "/articles/7?src=posts&page=2"},
+	} {
+		w := get(h, "GET", c.target)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != c.location {
+			t.Errorf("%s: got %d to %q, want %q", c.target, w.Code, w.Header().Get("Location"), c.location)
+		}
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	for _, c := range []struct {
+		host     string
+		port     int
+		location string
+	}{
+		{"example.com", 0, "https://example.com/a?b=c"},
+		{"example.com:8080", 0, "https://example.com/a?b=c"},
+		{"example.com:8080", 443, "https://example.com/a?b=c"},
+		{"example.com", 8443, "https://example.com:8443/a?b=c"},
+		{"[::1]", 0, "https://[::1]/a?b=c"},
+		{"[::1]:8080", 0, "https://[::1]/a?b=c"},
+		{"[::1]", 8443, "https://[::1]:8443/a?b=c"},
+		{"[2001:db8::1]:80", 8443, "https://[2001:db8::1]:8443/a?b=c"},
+	} {
+		r := httptest.NewRequest("GET", "/a?b=c", nil)
+		r.Host = c.host
+		w := httptest.NewRecorder()
+		HTTPSRedirectHandler(c.port).ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != c.location {
+			t.Errorf("%s, port %d: got %d to %q, want %q", c.host, c.port, w.Code, w.Header().Get("Location"), c.location)
+		}
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"index.html":     "home",
+		"a.txt":          "a",
+		"sub/index.html": "sub",
+	})
+	h := testHandler(t, ServerConfig{Serves: []Serve{
+		{Path: "/prefix", Target: dir, TrailingSlash: "add"},
+		{Path: "/prefix/", Target: dir, TrailingSlash: "add"},
+		{Path: "/strip/", Target: dir, TrailingSlash: "strip"},
+	}})
+	for _, c := range []struct {
+		target   string
+		code     int
+		location string
+	}{
+		{"/prefix", http.StatusMovedPermanently, "prefix/"},
+		{"/prefix?q=1", http.StatusMovedPermanently, "prefix/?q=1"},
+		{"/prefix/", http.StatusOK, ""},
+		{"/prefix/sub", http.StatusMovedPermanently, "sub/"},
+		{"/prefix/sub/", http.StatusOK, ""},
+		{"/prefix/a.txt", http.StatusOK, ""},
+		{"/strip/", http.StatusOK, ""},
+		{"/strip/a.txt/", http.StatusMovedPermanently, "../a.txt"},
+		{"/strip/a.txt", http.StatusOK, ""},
+		{"/strip/sub/", http.StatusOK, ""},
+	} {
+		w := get(h, "GET", c.target)
+		if w.Code != c.code || w.Header().Get("Location") != c.location {
+			t.Errorf("%s: got %d to %q, want %d to %q", c.target, w.Code, w.Header().Get("Location"), c.code, c.location)
+		}
+	}
+}
+
+func TestTargets(t *testing.T) {
+	first := writeFiles(t, map[string]string{"a.txt": "first a"})
+	second := writeFiles(t, map[string]string{"a.txt": "second a", "b.txt": "second b"})
+	h := testHandler(t, ServerConfig{Serves: []Serve{
+		{Path: "/", Target: first, Targets: []string{second}},
+	}})
+	for _, c := range []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/a.txt", http.StatusOK, "first a"},
+		{"/b.txt", http.StatusOK, "second b"},
+		{"/c.txt", http.StatusForbidden, ""}, // in neither, with indexes off
+	} {
+		w := get(h, "GET", c.target)
+		if w.Code != c.code || (c.body != "" && w.Body.String() != c.body) {
+			t.Errorf("%s: got %d %q", c.target, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestRemoveHeaders(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.txt": "a"})
+	h := testHandler(t, ServerConfig{
+		Listeners: []Listener{{Protocol: "http", Addr: "127.0.0.1:0", RemoveHeaders: []string{"X-Internal"}}},
+		Serves: []Serve{{
+			Path:          "/",
+			Target:        dir,
+			Headers:       Headers{"X-Internal": "1", "X-Public": "1"},
+			RemoveHeaders: []string{"last-modified"},
+		}},
+	})
+	w := get(h, "GET", "/a.txt")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	for _, name := range []string{"Last-Modified", "X-Internal"} {
+		if v, ok := w.Header()[name]; ok {
+			t.Errorf("expected %s to be removed, got %q", name, v)
+		}
+	}
+	for _, name := range []string{"Content-Type", "Accept-Ranges", "X-Public"} {
+		if w.Header().Get(name) == "" {
+			t.Errorf("expected %s to remain", name)
+		}
+	}
+}
+
+func TestForceHeaders(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"a.txt": "a"})
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	h := testHandler(t, ServerConfig{Serves: []Serve{
+		{
+			Path:         "/",
+			Target:       dir,
+			ForceHeaders: Headers{"Last-Modified": lastModified, "X-Frame-Options": "DENY"},
+		},
+		{
+			Path:        "/custom/",
+			Target:      dir,
+			StripPrefix: "/custom",
+			Headers:     Headers{"Last-Modified": lastModified, "X-Frame-Options": "DENY"},
+		},
+	}})
+
+	// Forced headers replace the file server's, as well as being added
+	w := get(h, "GET", "/a.txt")
+	if got := w.Header().Get("Last-Modified"); got != lastModified {
+		t.Errorf("forced: got Last-Modified %q", got)
+	}
+	if got := w.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("forced: got X-Frame-Options %q", got)
+	}
+
+	// Custom headers are replaced by the file server
+	w = get(h, "GET", "/custom/a.txt")
+	if got := w.Header().Get("Last-Modified"); got == lastModified || got == "" {
+		t.Errorf("custom: got Last-Modified %q", got)
+	}
+	if got := w.Header().Get("X-Frame-Options"); got != "DENY" {
+		t.Errorf("custom: got X-Frame-Options %q", got)
+	}
+}
+
+func TestListingErrorPage(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"empty/a.txt":  "a",
+		"own/b.txt":    "b",
+		"own/403.html": "serve forbidden",
+	})
+	page := filepath.Join(writeFiles(t, map[string]string{"403.html": "global forbidden"}), "403.html")
+	h := testHandler(t, ServerConfig{
+		Serves: []Serve{
+			{Path: "/", Target: dir, Indexes: false},
+			{Path: "/own/", Target: filepath.Join(dir, "own"), StripPrefix: "/own", ErrorPages: map[int]string{403: "403.html"}},
+		},
+		Errors: []Error{{Status: http.StatusForbidden, Target: page}},
+	})
+	for _, c := range []struct {
+		target, body string
+	}{
+		{"/empty/", "global forbidden"},
+		{"/own/", "serve forbidden"},
+	} {
+		w := get(h, "GET", c.target)
+		if w.Code != http.StatusForbidden || w.Body.String() != c.body {
+			t.Errorf("%s: got %d %q", c.target, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestForceDownload(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"report.pdf":    "pdf",
+		"my report.PDF": "pdf",
+		"résumé.pdf":    "pdf",
+		"a.txt":         "a",
+	})
+	h := testHandler(t, ServerConfig{Serves: []Serve{
+		{Path: "/", Target: dir, ForceDownload: []string{".pdf"}},
+	}})
+	for _, c := range []struct {
+		target, disposition string
+	}{
+		{"/report.pdf", "attachment; filename=report.pdf"},
+		{"/my%20report.PDF", `attachment; filename="my report.PDF"`},
+		{"/r%C3%A9sum%C3%A9.pdf", "attachment; filename*=utf-8''r%C3%A9sum%C3%A9.pdf"},
+		{"/a.txt", ""},
+	} {
+		w := get(h, "GET", c.target)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d", c.target, w.Code)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != c.disposition {
+			t.Errorf("%s: got Content-Disposition %q, expected %q", c.target, got, c.disposition)
+		}
+	}
+}
+
+// countingFS counts the files opened from a file system.
+type countingFS struct {
+	http.FileSystem
+	opened int
+}
+
+func (fs *countingFS) Open(name string) (http.File, error) {
+	fs.opened++
+	return fs.FileSystem.Open(name)
+}
+
+func TestMirrorDirs(t *testing.T) {
+	light := &countingFS{FileSystem: http.Dir(writeFiles(t, map[string]string{"a.txt": "a"}))}
+	heavy := &countingFS{FileSystem: http.Dir(writeFiles(t, map[string]string{"a.txt": "a", "b.txt": "b"}))}
+	var m MirrorDirs
+	m.add(light, 1)
+	m.add(heavy, 3)
+
+	const n = 4000
+	for i := 0; i < n; i++ {
+		f, err := m.Open("/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+	// Reads are spread in proportion to weight, give or take
+	if light.opened < n/4-200 || light.opened > n/4+200 || light.opened+heavy.opened != n {
+		t.Errorf("opened %d from weight 1, %d from weight 3", light.opened, heavy.opened)
+	}
+
+	// Files missing from the chosen mirror are opened from the others
+	for i := 0; i < 20; i++ {
+		f, err := m.Open("/b.txt")
+		if err != nil {
+			t.Fatalf("b.txt: %s", err)
+		}
+		f.Close()
+	}
+}
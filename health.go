@@ -0,0 +1,43 @@
+package goserve
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// checkHealthPath checks a health or readiness path, which may be empty.
+func checkHealthPath(label, name, p string) bool {
+	if p != "" && !strings.HasPrefix(p, "/") {
+		log.Printf(label+": %s `%s` must begin with /", name, p)
+		return false
+	}
+	return true
+}
+
+// HealthHandler responds to requests for healthPath with `200 OK` and the
+// body "ok", without passing them on to h. Requests for readinessPath are
+// answered likewise once ready returns true, and with
+// `503 Service Unavailable` until then. Either path may be empty to disable
+// it. Responses carry a Server header identifying the goserve version.
+func HealthHandler(h http.Handler, healthPath, readinessPath string, ready func() bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case healthPath != "" && r.URL.Path == healthPath:
+			w.Header().Set("Server", serverHeader())
+		case readinessPath != "" && r.URL.Path == readinessPath:
+			w.Header().Set("Server", serverHeader())
+			if !ready() {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+		default:
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, "ok")
+	})
+}
@@ -0,0 +1,104 @@
+package goserve
+
+import (
+	"gopkg.in/v1/yaml"
+
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// readConfigFile reads the named config file along with any files it
+// includes. parents holds the absolute paths of the files including it, which
+// are used to detect include cycles.
+func readConfigFile(filename string, parents []string) (cfg ServerConfig, err error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return
+	}
+	for _, p := range parents {
+		if p == abs {
+			err = fmt.Errorf("include cycle: %s -> %s", strings.Join(parents, " -> "), abs)
+			return
+		}
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(expandEnv(data), &cfg); err != nil {
+		return
+	}
+	err = cfg.resolveIncludes(filename, append(parents[:len(parents):len(parents)], abs))
+	return
+}
+
+// resolveIncludes reads the files included by c, which was read from
+// filename, and merges them into c. Include paths are relative to the
+// directory containing filename, and may contain glob patterns.
+func (c *ServerConfig) resolveIncludes(filename string, parents []string) error {
+	includes := c.Include
+	c.Include = nil
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid include `%s`: %s", pattern, err)
+		}
+		// Plain paths must exist; patterns may match nothing
+		if len(matches) == 0 && !strings.ContainsAny(pattern, `*?[\`) {
+			matches = []string{pattern}
+		}
+		for _, match := range matches {
+			inc, err := readConfigFile(match, parents)
+			if err != nil {
+				return err
+			}
+			if err := c.merge(inc); err != nil {
+				return fmt.Errorf("%s: %s", match, err)
+			}
+		}
+	}
+	return nil
+}
+
+// merge appends the listeners, serves, errors and redirects of an included
+// config to c. Listeners on addresses already in use and handlers for errors
+// already handled are rejected, as are any other settings, which may only be
+// given in the main config file.
+func (c *ServerConfig) merge(inc ServerConfig) error {
+	if inc.AccessLog != nil || inc.Metrics != nil || len(inc.MIMETypes) > 0 ||
+		inc.HealthPath != "" || inc.ReadinessPath != "" || inc.LogFormat != "" ||
+		len(inc.MiddlewareOrder) > 0 || inc.ShutdownTimeout != "" || inc.DrainDelay != "" ||
+		inc.RequestIDHeader != "" || inc.MaintenanceFile != "" || inc.MaintenancePage != "" ||
+		len(inc.MaintenanceAllow) > 0 {
+		return fmt.Errorf("only listeners, serves, errors and redirects may be included")
+	}
+	for _, l := range inc.Listeners {
+		for _, existing := range c.Listeners {
+			for _, addr := range l.addresses() {
+				for _, existingAddr := range existing.addresses() {
+					if addr == existingAddr {
+						return fmt.Errorf("duplicate listener address `%s`", addr)
+					}
+				}
+			}
+		}
+		c.Listeners = append(c.Listeners, l)
+	}
+	for _, e := range inc.Errors {
+		for _, existing := range c.Errors {
+			if e.Status == existing.Status {
+				return fmt.Errorf("conflicting handlers for error %d", e.Status)
+			}
+		}
+		c.Errors = append(c.Errors, e)
+	}
+	c.Serves = append(c.Serves, inc.Serves...)
+	c.Redirects = append(c.Redirects, inc.Redirects...)
+	return nil
+}
@@ -0,0 +1,128 @@
+package goserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ListingEntry describes a file within a directory listing.
+type ListingEntry struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"` // escaped, relative URL of the entry
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	IsDir   bool      `json:"isDir"`
+}
+
+// Listing is the data passed to directory listing templates.
+type Listing struct {
+	Path    string // directory path, as requested
+	Entries []ListingEntry
+}
+
+// readListing returns a listing of the named directory, sorted by name.
+func readListing(fs http.FileSystem, name string) (*Listing, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := &Listing{Path: name, Entries: []ListingEntry{}}
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() {
+			name += "/"
+		}
+		listing.Entries = append(listing.Entries, ListingEntry{
+			Name:    fi.Name(),
+			URL:     (&url.URL{Path: name}).String(),
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			IsDir:   fi.IsDir(),
+		})
+	}
+	sort.Slice(listing.Entries, func(i, j int) bool {
+		return listing.Entries[i].Name < listing.Entries[j].Name
+	})
+	return listing, nil
+}
+
+// ListingTemplateHandler renders directory listings with tmpl, for
+// directories that lack an index.html file. All other requests are passed on
+// to h. Names are escaped by html/template, so are safe to output directly.
+func ListingTemplateHandler(h http.Handler, fs http.FileSystem, tmpl *template.Template) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		if !strings.HasSuffix(p, "/") || exists(fs, path.Join(p, "index.html")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		listing, err := readListing(fs, p)
+		if err != nil {
+			// Let the file server deal with missing directories etc.
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Render fully before writing, so errors can still be reported
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, listing); err != nil {
+			log.Printf("Couldn't render listing of %s: %s\n", p, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		buf.WriteTo(w)
+	})
+}
+
+// ListingJSONHandler responds to requests for directories with the query
+// parameter `format=json` with a JSON array of the directory's entries, for
+// directories that lack an index.html file. All other requests are passed on
+// to h.
+func ListingJSONHandler(h http.Handler, fs http.FileSystem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		if r.URL.Query().Get("format") != "json" || !strings.HasSuffix(p, "/") ||
+			exists(fs, path.Join(p, "index.html")) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		listing, err := readListing(fs, p)
+		if err != nil {
+			// Let the file server deal with missing directories etc.
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		b, err := json.Marshal(listing.Entries)
+		if err != nil {
+			log.Printf("Couldn't encode listing of %s: %s\n", p, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
@@ -0,0 +1,109 @@
+package goserve
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// logFormats are the accepted values of `log-format`.
+var logFormats = []string{"text", "json"}
+
+// jsonLogs is set when logs, including access logs, are written as JSON.
+var jsonLogs bool
+
+// CheckLogFormat returns true if format is a known log format.
+func CheckLogFormat(label, format string) bool {
+	for _, f := range logFormats {
+		if format == f {
+			return true
+		}
+	}
+	log.Printf(label+": unknown log format `%s` (expected one of %s)", format, strings.Join(logFormats, ", "))
+	return false
+}
+
+// SetLogFormat directs output from the log package through a writer for the
+// given format.
+func SetLogFormat(format string) {
+	jsonLogs = format == "json"
+	if jsonLogs {
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{os.Stderr})
+	} else {
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// jsonLogEntry is a general log message, as written in JSON.
+type jsonLogEntry struct {
+	Time  string `json:"time"`
+	Level string `json:"level"`
+	Msg   string `json:"msg"`
+}
+
+// logLevelPrefixes maps the beginnings of log messages to their levels in
+// JSON logs. Config check failures begin with the label of the part of the
+// config at fault. Other messages are at info level, except for those ending
+// with "Exiting.", which are fatal.
+var logLevelPrefixes = []struct {
+	prefix, level string
+}{
+	{"Warning: ", "warn"},
+	{"Defaulting ", "warn"},
+	{"Rejecting ", "warn"},
+	{"Couldn't ", "error"},
+	{"Panic ", "error"},
+	{"Invalid ", "error"},
+	{"Unknown ", "error"},
+	{"No ", "error"},
+	{"Too many ", "error"},
+	{"Middleware ", "error"},
+	{"Access logs ", "error"},
+	{"Config: ", "error"},
+	{"Listener #", "error"},
+	{"Serve #", "error"},
+	{"Redirect #", "error"},
+	{"Error #", "error"},
+	{"Access log: ", "error"},
+	{"Metrics: ", "error"},
+}
+
+// logLevel returns the level of the given log message.
+func logLevel(msg string) string {
+	if strings.HasSuffix(msg, "Exiting.") {
+		return "fatal"
+	}
+	for _, l := range logLevelPrefixes {
+		if strings.HasPrefix(msg, l.prefix) {
+			return l.level
+		}
+	}
+	return "info"
+}
+
+// jsonLogWriter rewrites each message written by the log package as a JSON
+// object on a line of its own.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (j jsonLogWriter) Write(b []byte) (int, error) {
+	msg := strings.TrimSuffix(string(b), "\n")
+	line, err := json.Marshal(jsonLogEntry{
+		Time:  time.Now().Format(time.RFC3339Nano),
+		Level: logLevel(msg),
+		Msg:   msg,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := j.w.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
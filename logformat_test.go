@@ -0,0 +1,35 @@
+package goserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"testing"
+)
+
+func TestJSONLogLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := log.New(jsonLogWriter{&buf}, "", 0)
+	for msg, level := range map[string]string{
+		"listening on HTTP :80":                                   "info",
+		"Config check passed.":                                    "info",
+		"Couldn't start: address in use. Exiting.":                "fatal",
+		"Invalid config. Exiting.":                                "fatal",
+		"Couldn't reload config: invalid config. Keeping current": "error",
+		"Couldn't listen on HTTP :80: address in use":             "error",
+		"Serve #2: no path specified":                             "error",
+		"Config: invalid request ID header `X Y`":                 "error",
+		"Warning: Redirect #0: from `/` overlaps serve #0":        "warn",
+		"Defaulting status code 301 for redirect /old":            "warn",
+	} {
+		buf.Reset()
+		l.Println(msg)
+		var entry jsonLogEntry
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("%q: %s", buf.String(), err)
+		}
+		if entry.Msg != msg || entry.Level != level {
+			t.Errorf("%q: got level %q, msg %q, want level %q", msg, entry.Level, entry.Msg, level)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package goserve
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics describes where request metrics are exposed for scraping by
+// Prometheus. They're served by a listener of their own, so that they may
+// be kept private.
+type Metrics struct {
+	Addr string `yaml:"addr"`           // address of the metrics listener
+	Path string `yaml:"path,omitempty"` // defaults to /metrics
+}
+
+func (m *Metrics) sanitise() {
+	if m.Path == "" {
+		m.Path = "/metrics"
+	}
+}
+
+func (m Metrics) check(label string) (ok bool) {
+	ok = true
+	if m.Addr == "" {
+		log.Println(label + ": no metrics address specified")
+		ok = false
+	}
+	if !strings.HasPrefix(m.Path, "/") {
+		log.Printf(label+": metrics path `%s` must begin with /", m.Path)
+		ok = false
+	}
+	return
+}
+
+// server returns a server exposing the recorder's metrics.
+func (m Metrics) server(recorder *MetricsRecorder) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(m.Path, recorder)
+	return &http.Server{Addr: m.Addr, Handler: mux}
+}
+
+// durationBuckets are the upper bounds, in seconds, of the request duration
+// histogram's buckets.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// MetricsRecorder accumulates request metrics, and serves them in the
+// Prometheus text format.
+type MetricsRecorder struct {
+	mu        sync.Mutex
+	requests  uint64
+	classes   [6]uint64 // by status / 100
+	durations []uint64  // per bucket, not cumulative
+	duration  float64   // total seconds
+	bytes     uint64
+}
+
+// NewMetricsRecorder allocates and returns a new MetricsRecorder.
+func NewMetricsRecorder() *MetricsRecorder {
+	return &MetricsRecorder{durations: make([]uint64, len(durationBuckets))}
+}
+
+// Observe records a served request.
+func (m *MetricsRecorder) Observe(status int, bytes int64, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	if class := status / 100; class > 0 && class < len(m.classes) {
+		m.classes[class]++
+	}
+	seconds := elapsed.Seconds()
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			m.durations[i]++
+			break
+		}
+	}
+	m.duration += seconds
+	m.bytes += uint64(bytes)
+}
+
+func (m *MetricsRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Server", serverHeader())
+	fmt.Fprintln(w, "# HELP goserve_requests_total Total number of requests served.")
+	fmt.Fprintln(w, "# TYPE goserve_requests_total counter")
+	fmt.Fprintf(w, "goserve_requests_total %d\n", m.requests)
+
+	fmt.Fprintln(w, "# HELP goserve_responses_total Number of responses by status class.")
+	fmt.Fprintln(w, "# TYPE goserve_responses_total counter")
+	for class := 1; class < len(m.classes); class++ {
+		fmt.Fprintf(w, "goserve_responses_total{class=\"%dxx\"} %d\n", class, m.classes[class])
+	}
+
+	fmt.Fprintln(w, "# HELP goserve_request_duration_seconds Time taken to serve requests.")
+	fmt.Fprintln(w, "# TYPE goserve_request_duration_seconds histogram")
+	var cumulative uint64
+	for i, le := range durationBuckets {
+		cumulative += m.durations[i]
+		fmt.Fprintf(w, "goserve_request_duration_seconds_bucket{le=\"%s\"} %d\n",
+			strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "goserve_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.requests)
+	fmt.Fprintf(w, "goserve_request_duration_seconds_sum %s\n", strconv.FormatFloat(m.duration, 'g', -1, 64))
+	fmt.Fprintf(w, "goserve_request_duration_seconds_count %d\n", m.requests)
+
+	fmt.Fprintln(w, "# HELP goserve_response_bytes_total Total size of response bodies served.")
+	fmt.Fprintln(w, "# TYPE goserve_response_bytes_total counter")
+	fmt.Fprintf(w, "goserve_response_bytes_total %d\n", m.bytes)
+}
+
+// MetricsHandler records the status, size and duration of each request with
+// recorder once it has been served.
+func MetricsHandler(h http.Handler, recorder *MetricsRecorder) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &LoggingResponseWriter{ResponseWriter: w}
+		defer func() {
+			status := lw.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			recorder.Observe(status, lw.Bytes, time.Since(start))
+		}()
+		h.ServeHTTP(lw, r)
+	})
+}
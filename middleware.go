@@ -0,0 +1,134 @@
+package goserve
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Middleware wraps a listener's handler with additional behaviour. It should
+// return the handler unchanged if it isn't enabled for the given listener.
+type Middleware func(h http.Handler, l *Listener) http.Handler
+
+// middlewares maps the names usable in `middleware-order` to their
+// implementations.
+var middlewares = map[string]Middleware{
+	"access-log": accessLogMiddleware,
+	"rate-limit": rateLimitMiddleware,
+	"compress":   compressMiddleware,
+	"headers":    headersMiddleware,
+}
+
+// fixedMiddleware names the stages of a listener's handler chain that run at
+// fixed points around the reorderable middleware, and so can't be named in
+// `middleware-order`.
+var fixedMiddleware = map[string]bool{
+	"request-id":        true,
+	"client-cert":       true,
+	"server-header":     true,
+	"acme":              true,
+	"health":            true,
+	"draining":          true,
+	"allowed-hosts":     true,
+	"max-connections":   true,
+	"max-request-body":  true,
+	"request-timeout":   true,
+	"redirect-to-https": true,
+}
+
+// defaultMiddlewareOrder lists listener middleware from outermost (sees the
+// request first and the response last) to innermost.
+var defaultMiddlewareOrder = []string{
+	"access-log",
+	"rate-limit",
+	"compress",
+	"headers",
+}
+
+// middlewareOrder returns the effective middleware order. Middleware named in
+// order comes first, followed by any remaining middleware in default order.
+func middlewareOrder(order []string) []string {
+	named := make(map[string]bool)
+	effective := []string{}
+	for _, name := range order {
+		named[name] = true
+		effective = append(effective, name)
+	}
+	for _, name := range defaultMiddlewareOrder {
+		if !named[name] {
+			effective = append(effective, name)
+		}
+	}
+	return effective
+}
+
+// checkMiddlewareOrder returns true if order names only reorderable
+// middleware, each at most once.
+func checkMiddlewareOrder(order []string) (ok bool) {
+	ok = true
+	seen := make(map[string]bool)
+	for _, name := range order {
+		if fixedMiddleware[name] {
+			log.Printf("Middleware `%s` can't be reordered; only %s can", name, strings.Join(defaultMiddlewareOrder, ", "))
+			ok = false
+		} else if _, f := middlewares[name]; !f {
+			log.Printf("Unknown middleware `%s` in middleware order", name)
+			ok = false
+		} else if seen[name] {
+			log.Printf("Middleware `%s` listed more than once in middleware order", name)
+			ok = false
+		}
+		seen[name] = true
+	}
+	return
+}
+
+// applyMiddleware wraps h in the given middleware such that the first
+// middleware in order is outermost.
+func applyMiddleware(h http.Handler, l *Listener, order []string) http.Handler {
+	for i := len(order) - 1; i >= 0; i-- {
+		h = middlewares[order[i]](h, l)
+	}
+	return h
+}
+
+func accessLogMiddleware(h http.Handler, l *Listener) http.Handler {
+	if l.accessLogger == nil {
+		return h
+	}
+	return AccessLogHandler(h, l.accessLogger)
+}
+
+func rateLimitMiddleware(h http.Handler, l *Listener) http.Handler {
+	if l.rateLimiter == nil {
+		return h
+	}
+	return RateLimitHandler(h, l.rateLimiter)
+}
+
+func compressMiddleware(h http.Handler, l *Listener) http.Handler {
+	encodings := []string{}
+	if l.Brotli {
+		encodings = append(encodings, "br")
+	}
+	if l.Gzip {
+		encodings = append(encodings, "gzip")
+	}
+	if len(encodings) == 0 {
+		return h
+	}
+	return CompressHandler(h, encodings, defaultGzipOptions.merge(l.GzipOptions))
+}
+
+func headersMiddleware(h http.Handler, l *Listener) http.Handler {
+	if len(l.RemoveHeaders) > 0 {
+		h = RemoveHeadersHandler(h, l.RemoveHeaders)
+	}
+	if len(l.Headers) > 0 {
+		h = CustomHeadersHandler(h, l.Headers)
+	}
+	if len(l.ForceHeaders) > 0 {
+		h = ForceHeadersHandler(h, l.ForceHeaders)
+	}
+	return h
+}
@@ -0,0 +1,44 @@
+package goserve
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	for _, c := range []struct {
+		order, want []string
+	}{
+		{nil, defaultMiddlewareOrder},
+		{[]string{"headers", "compress"}, []string{"headers", "compress", "access-log", "rate-limit"}},
+		{[]string{"rate-limit"}, []string{"rate-limit", "access-log", "compress", "headers"}},
+	} {
+		if got := middlewareOrder(c.order); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got %v, want %v", c.order, got, c.want)
+		}
+	}
+}
+
+func TestCheckMiddlewareOrder(t *testing.T) {
+	for _, c := range []struct {
+		order []string
+		ok    bool
+	}{
+		{nil, true},
+		{[]string{"headers", "compress", "rate-limit", "access-log"}, true},
+		{[]string{"compress", "compress"}, false},
+		{[]string{"auth"}, false},
+		{[]string{"draining"}, false},
+		{[]string{"request-timeout", "headers"}, false},
+	} {
+		if ok := checkMiddlewareOrder(c.order); ok != c.ok {
+			t.Errorf("%v: check returned %t", c.order, ok)
+		}
+	}
+	// Every fixed stage is rejected, not just unknown names
+	for name := range fixedMiddleware {
+		if _, found := middlewares[name]; found {
+			t.Errorf("fixed middleware %s is also reorderable", name)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package goserve
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is the time allowed for a client to send its PROXY
+// protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature begins version 2 PROXY protocol headers.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// errBadProxyHeader is logged for connections whose PROXY protocol header is
+// missing or invalid.
+var errBadProxyHeader = errors.New("missing or invalid PROXY protocol header")
+
+// proxyProtocolListener accepts connections that begin with a PROXY protocol
+// (version 1 or 2) header, as sent by load balancers such as HAProxy and AWS
+// NLBs, giving them the remote address of the original client.
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (ln proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn is a connection whose PROXY protocol header is read, by the
+// connection's own goroutine, on first use. Connections without a valid
+// header can't be read from, so are dropped by the HTTP server.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr // nil unless given by the header
+	err        error
+
+	mu       sync.Mutex
+	deadline time.Time // read deadline set by the HTTP server, if any
+}
+
+// SetDeadline records the read deadline, so that it can be restored once
+// the header has been read.
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline records the read deadline, so that it can be restored once
+// the header has been read.
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// readHeader reads the PROXY protocol header, if it hasn't been already,
+// within proxyHeaderTimeout or any earlier deadline set by the HTTP server,
+// which then applies again.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		headerDeadline := time.Now().Add(proxyHeaderTimeout)
+		if !deadline.IsZero() && deadline.Before(headerDeadline) {
+			headerDeadline = deadline
+		}
+		c.Conn.SetReadDeadline(headerDeadline)
+		c.remoteAddr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(deadline)
+		if c.err != nil {
+			log.Printf("Rejecting connection from %s: %s\n", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		// Appear closed, so the HTTP server doesn't respond
+		return 0, io.EOF
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client's address as given by the PROXY protocol
+// header, or the address of the connection's peer if the header gives none
+// (such as for health checks from the proxy itself).
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header from r,
+// returning the source address it gives, if any.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	if b, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(b, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return readProxyHeaderV1(r)
+}
+
+// readProxyHeaderV1 reads a human-readable header, such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// Headers are at most 107 bytes, including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errBadProxyHeader
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errBadProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, errBadProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return nil, errBadProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errBadProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, errBadProxyHeader
+	}
+	verCmd, family := hdr[12], hdr[13]
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errBadProxyHeader
+	}
+	if verCmd>>4 != 2 {
+		return nil, errBadProxyHeader
+	}
+	switch verCmd & 0xf {
+	case 0: // LOCAL, e.g. health checks from the proxy itself
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errBadProxyHeader
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errBadProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// Other families (UDP, Unix sockets, unspecified) carry no useful address
+	return nil, nil
+}
@@ -0,0 +1,70 @@
+package goserve
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		addr   string
+		ok     bool
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", true},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", true},
+		{"PROXY UNKNOWN\r\n", "", true},
+		{"GET / HTTP/1.1\r\n", "", false},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", false},
+		{string(proxyV2Signature) + "\x21\x11\x00\x0c\xc0\x00\x02\x01\xc6\x33\x64\x01\xdc\x04\x01\xbb", "192.0.2.1:56324", true},
+		{string(proxyV2Signature) + "\x20\x00\x00\x00", "", true},
+	} {
+		addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(c.header)))
+		if (err == nil) != c.ok {
+			t.Errorf("%q: got error %v", c.header, err)
+			continue
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != c.addr {
+			t.Errorf("%q: got address %q, want %q", c.header, got, c.addr)
+		}
+	}
+}
+
+// deadlineConn records the read deadline set on it.
+type deadlineConn struct {
+	net.Conn
+	deadline time.Time
+}
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func TestProxyConnKeepsDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET"))
+
+	dc := &deadlineConn{Conn: server}
+	c := &proxyConn{Conn: dc, r: bufio.NewReader(dc)}
+	deadline := time.Now().Add(time.Minute)
+	c.SetReadDeadline(deadline)
+	b := make([]byte, 3)
+	if _, err := c.Read(b); err != nil || string(b) != "GET" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	if got := c.RemoteAddr().String(); got != "192.0.2.1:56324" {
+		t.Errorf("got remote address %s", got)
+	}
+	if !dc.deadline.Equal(deadline) {
+		t.Errorf("got deadline %s after reading the header, want %s", dc.deadline, deadline)
+	}
+}
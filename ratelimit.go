@@ -0,0 +1,135 @@
+package goserve
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit describes how many requests each client may make.
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests-per-second"`
+	Burst             int     `yaml:"burst,omitempty"` // defaults to one second's worth
+}
+
+func (rl RateLimit) check(label string) (ok bool) {
+	ok = true
+	if rl.RequestsPerSecond <= 0 {
+		log.Println(label + ": rate limit must allow a positive number of requests per second")
+		ok = false
+	}
+	if rl.Burst < 0 {
+		log.Printf(label+": negative rate limit burst %d", rl.Burst)
+		ok = false
+	}
+	return
+}
+
+// bucket holds the tokens available to a single client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token-bucket rate limiter keyed by client.
+type RateLimiter struct {
+	rate    float64 // tokens added per second
+	burst   float64 // maximum tokens held
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	stop    chan struct{} // closed by Stop
+}
+
+// NewRateLimiter allocates and returns a new RateLimiter, and starts a
+// goroutine that periodically discards the state of idle clients, until the
+// limiter is stopped.
+func NewRateLimiter(rl RateLimit) *RateLimiter {
+	burst := float64(rl.Burst)
+	if burst == 0 {
+		burst = math.Max(1, math.Ceil(rl.RequestsPerSecond))
+	}
+	l := &RateLimiter{
+		rate:    rl.RequestsPerSecond,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+		stop:    make(chan struct{}),
+	}
+	go l.collectEvery(time.Minute)
+	return l
+}
+
+// Stop stops discarding the state of idle clients. It must only be called
+// once, when the limiter is no longer in use.
+func (l *RateLimiter) Stop() {
+	close(l.stop)
+}
+
+// collectEvery collects idle buckets at the given interval, until stopped.
+func (l *RateLimiter) collectEvery(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			l.collect(now)
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+// Allow takes a token for the given client if one is available. Otherwise
+// it returns false and how long until a token will be available.
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// collect discards buckets that have refilled completely, as they're
+// equivalent to no bucket at all.
+func (l *RateLimiter) collect(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimitHandler limits the rate at which each client (as identified by
+// its resolved IP address) may make requests, responding with
+// `429 Too Many Requests` to those exceeding it.
+func RateLimitHandler(h http.Handler, l *RateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.RemoteAddr
+		if ip := GetRequestInfo(r).ClientIP; ip != nil {
+			key = ip.String()
+		}
+		if ok, wait := l.Allow(key, time.Now()); !ok {
+			retry := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
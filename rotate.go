@@ -0,0 +1,206 @@
+package goserve
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backupTimeFormat is appended to the name of a log file, along with a dot,
+// to name its backups when rotated.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// rotatingFile is a log file that's rotated once it reaches a maximum size,
+// keeping a limited number of backups for a limited time. Zero limits are
+// unlimited.
+//
+// Compressed files are written as a series of gzip members, each finished
+// when the file is rotated or closed, so that every backup is a complete
+// gzip file. Members are flushed periodically in the meantime.
+type rotatingFile struct {
+	path       string
+	maxSize    int64 // of the file on disk, so compressed if compressing
+	maxAge     time.Duration
+	maxBackups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64    // accessed atomically, as gz flushes to f concurrently
+	gz   *gzipLog // nil unless compressing
+}
+
+// openRotatingFile opens the log file at path for appending, creating it if
+// it doesn't exist, and removes any expired backups.
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	r.prune()
+	if compress {
+		r.gz = newGzipLog(fileWriter{r}, path, gzipFlushInterval)
+	}
+	return r, nil
+}
+
+// fileWriter writes to a rotatingFile's current file, counting the bytes
+// written.
+type fileWriter struct {
+	r *rotatingFile
+}
+
+func (w fileWriter) Write(b []byte) (int, error) {
+	n, err := w.r.f.Write(b)
+	atomic.AddInt64(&w.r.size, int64(n))
+	return n, err
+}
+
+// finishGzip finishes the current gzip member, if compressing, before the
+// file is replaced. r.mu must be held.
+func (r *rotatingFile) finishGzip() {
+	if r.gz == nil {
+		return
+	}
+	if err := r.gz.finish(); err != nil {
+		log.Printf("Couldn't compress %s: %s\n", r.path, err)
+	}
+}
+
+// startGzip starts a new gzip member, if compressing, once the file has been
+// replaced. r.mu must be held.
+func (r *rotatingFile) startGzip() {
+	if r.gz != nil {
+		r.gz.start(fileWriter{r})
+	}
+}
+
+// rotates returns true if the file is rotated, rather than growing forever.
+func (r *rotatingFile) rotates() bool {
+	return r.maxSize > 0 || r.maxAge > 0 || r.maxBackups > 0
+}
+
+// open opens the log file, replacing the current one only if successful.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	atomic.StoreInt64(&r.size, fi.Size())
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	size := atomic.LoadInt64(&r.size)
+	if r.maxSize > 0 && size > 0 && size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			log.Printf("Couldn't rotate %s: %s\n", r.path, err)
+		}
+	}
+	if r.gz != nil {
+		return r.gz.Write(b)
+	}
+	return fileWriter{r}.Write(b)
+}
+
+// rotate renames the log file to a backup and starts a new one. If the new
+// one can't be opened, writing continues to the backup, so nothing is lost.
+// r.mu must be held.
+func (r *rotatingFile) rotate() error {
+	r.finishGzip()
+	defer r.startGzip()
+	backup := r.path + "." + time.Now().Format(backupTimeFormat)
+	if err := os.Rename(r.path, backup); err != nil {
+		return err
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	old.Close()
+	r.prune()
+	return nil
+}
+
+// Rotate rotates the log file if it has any limits. Otherwise, it just opens
+// the file again, in case it's been moved aside by another tool (such as
+// logrotate).
+func (r *rotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rotates() {
+		return r.rotate()
+	}
+	r.finishGzip()
+	defer r.startGzip()
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// Close finishes writing the log file, and closes it.
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.gz != nil {
+		if err := r.gz.Close(); err != nil {
+			log.Printf("Couldn't compress %s: %s\n", r.path, err)
+		}
+	}
+	return r.f.Close()
+}
+
+// prune removes the oldest backups in excess of maxBackups, and any older
+// than maxAge.
+func (r *rotatingFile) prune() {
+	if r.maxAge == 0 && r.maxBackups == 0 {
+		return
+	}
+	dir, prefix := filepath.Dir(r.path), filepath.Base(r.path)+"."
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	// Backups are sorted oldest first, as the time is in sortable form
+	var backups []string
+	var times []time.Time
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, fi.Name()[len(prefix):], time.Local)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, fi.Name())
+		times = append(times, t)
+	}
+	for i, name := range backups {
+		if (r.maxBackups > 0 && i < len(backups)-r.maxBackups) ||
+			(r.maxAge > 0 && time.Since(times[i]) > r.maxAge) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				log.Printf("Couldn't remove old log %s: %s\n", name, err)
+			}
+		}
+	}
+}
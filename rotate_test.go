@@ -0,0 +1,92 @@
+package goserve
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readGzip returns the decompressed content of the named file.
+func readGzip(t *testing.T, name string) string {
+	t.Helper()
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return string(b)
+}
+
+func TestRotatingFileGzip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log.gz")
+	r, err := openRotatingFile(path, 0, 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("one\n"))
+	if err := r.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("two\n"))
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readGzip(t, path); got != "one\ntwo\n" {
+		t.Errorf("reopened file contains %q", got)
+	}
+
+	// Reopening appends another member, read as part of the same file
+	if r, err = openRotatingFile(path, 0, 0, 1, true); err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("three\n"))
+	if err := r.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("four\n"))
+	r.Close()
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("got backups %v", backups)
+	}
+	if got := readGzip(t, backups[0]); got != "one\ntwo\nthree\n" {
+		t.Errorf("rotated file contains %q", got)
+	}
+	if got := readGzip(t, path); got != "four\n" {
+		t.Errorf("new file contains %q", got)
+	}
+}
+
+func TestRotatingFileGzipFlush(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log.gz")
+	r, err := openRotatingFile(path, 0, 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	r.Write([]byte("line\n"))
+	r.gz.flush()
+
+	// The member is unfinished, but what's been flushed can be read
+	f, _ := os.Open(path)
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(zr)
+	if !strings.HasPrefix(string(b), "line\n") {
+		t.Errorf("flushed file contains %q", b)
+	}
+}
@@ -0,0 +1,198 @@
+package goserve
+
+import (
+	"bytes"
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSitemapURLs is the most URLs a sitemap may list.
+const maxSitemapURLs = 50000
+
+// Sitemap describes a sitemap.xml generated from the HTML files of a serve.
+type Sitemap struct {
+	BaseURL string `yaml:"base-url"`       // site URL the serve's path is relative to, e.g. "https://example.com"
+	Path    string `yaml:"path,omitempty"` // relative to the serve's path; defaults to /sitemap.xml
+}
+
+func (sm *Sitemap) sanitise() {
+	if sm.Path == "" {
+		sm.Path = "/sitemap.xml"
+	}
+}
+
+func (sm Sitemap) check(label string) (ok bool) {
+	ok = true
+	u, err := url.Parse(sm.BaseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		log.Printf(label+": invalid sitemap base URL `%s`", sm.BaseURL)
+		ok = false
+	}
+	if !strings.HasPrefix(sm.Path, "/") || strings.HasSuffix(sm.Path, "/") {
+		log.Printf(label+": invalid sitemap path `%s`", sm.Path)
+		ok = false
+	}
+	return
+}
+
+// sitemapURLSet is the root element of a sitemap.
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+// sitemapGenerator builds a sitemap by walking a file system, and caches it
+// until the modification time of any of the directories walked changes (as
+// happens when files are added, removed or replaced by renaming).
+type sitemapGenerator struct {
+	fs        http.FileSystem
+	base      string // site URL, without a trailing slash
+	prefix    string // path that file paths are appended to
+	stripHTML bool   // list /x.html as /x
+
+	mu      sync.Mutex
+	content []byte
+	modTime time.Time            // of the newest file or directory walked
+	dirs    map[string]time.Time // directories walked, and their mtimes
+}
+
+// stale returns true if the sitemap hasn't been generated yet, or any of the
+// directories walked has changed since. g.mu must be held.
+func (g *sitemapGenerator) stale() bool {
+	if g.content == nil {
+		return true
+	}
+	for name, modTime := range g.dirs {
+		f, err := g.fs.Open(name)
+		if err != nil {
+			return true
+		}
+		fi, err := f.Stat()
+		f.Close()
+		if err != nil || !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// generate walks the file system for HTML files, other than hidden ones, and
+// renders the sitemap listing them. g.mu must be held.
+func (g *sitemapGenerator) generate() error {
+	dirs := make(map[string]time.Time)
+	var urls []sitemapURL
+	var newest time.Time
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		f, err := g.fs.Open(dir)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		dirs[dir] = fi.ModTime()
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+		fis, err := f.Readdir(-1)
+		if err != nil {
+			return err
+		}
+		sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+		for _, fi := range fis {
+			name := fi.Name()
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			if fi.IsDir() {
+				if err := walk(path.Join(dir, name)); err != nil {
+					return err
+				}
+				continue
+			}
+			if path.Ext(name) != ".html" {
+				continue
+			}
+			p := path.Join(dir, name)
+			if name == "index.html" {
+				p = strings.TrimSuffix(p, "index.html")
+			} else if g.stripHTML {
+				p = strings.TrimSuffix(p, ".html")
+			}
+			if fi.ModTime().After(newest) {
+				newest = fi.ModTime()
+			}
+			urls = append(urls, sitemapURL{
+				Loc:     g.base + (&url.URL{Path: g.prefix + p}).EscapedPath(),
+				LastMod: fi.ModTime().UTC().Format(time.RFC3339),
+			})
+		}
+		return nil
+	}
+	if err := walk("/"); err != nil {
+		return err
+	}
+	if len(urls) > maxSitemapURLs {
+		log.Printf("Sitemap of %s%s/ lists only the first %d of %d pages\n", g.base, g.prefix, maxSitemapURLs, len(urls))
+		urls = urls[:maxSitemapURLs]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(sitemapURLSet{URLs: urls}); err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	g.content, g.modTime, g.dirs = buf.Bytes(), newest, dirs
+	return nil
+}
+
+// SitemapHandler responds to requests for sitemapPath with a sitemap of the
+// HTML files in fs, as served under prefix on the site at base. Directories'
+// index.html files are listed as the directories themselves, and with
+// stripHTML, other files are listed without their .html extension. All other
+// requests are passed on to h.
+func SitemapHandler(h http.Handler, fs http.FileSystem, sitemapPath, base, prefix string, stripHTML bool) http.Handler {
+	g := &sitemapGenerator{
+		fs:        fs,
+		base:      strings.TrimSuffix(base, "/"),
+		prefix:    strings.TrimSuffix(prefix, "/"),
+		stripHTML: stripHTML,
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := r.URL.Path; p != sitemapPath && "/"+p != sitemapPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+		g.mu.Lock()
+		if g.stale() {
+			if err := g.generate(); err != nil {
+				g.mu.Unlock()
+				log.Printf("Couldn't generate sitemap %s: %s\n", sitemapPath, err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+		content, modTime := g.content, g.modTime
+		g.mu.Unlock()
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		http.ServeContent(w, r, "sitemap.xml", modTime, bytes.NewReader(content))
+	})
+}
@@ -0,0 +1,76 @@
+package goserve
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// fdAddrPrefix begins addresses naming sockets passed by systemd socket
+// activation, e.g. "fd://0" for the first.
+const fdAddrPrefix = "fd://"
+
+// systemdFirstFD is the first file descriptor passed by systemd; the rest
+// follow in order.
+const systemdFirstFD = 3
+
+// isFDAddr returns true if addr names a socket-activated file descriptor.
+func isFDAddr(addr string) bool {
+	return strings.HasPrefix(addr, fdAddrPrefix)
+}
+
+// parseFDAddr returns the index of the file descriptor named by an address
+// of the form "fd://N".
+func parseFDAddr(addr string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(addr, fdAddrPrefix))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid file descriptor address `%s`", addr)
+	}
+	return n, nil
+}
+
+// systemdFDCount returns the number of file descriptors passed to this
+// process by systemd, going by the LISTEN_PID and LISTEN_FDS environment
+// variables.
+func systemdFDCount() int {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return 0
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+func checkFDAddr(label, addr string) bool {
+	n, err := parseFDAddr(addr)
+	if err != nil {
+		log.Println(label + ": " + err.Error())
+		return false
+	}
+	if count := systemdFDCount(); n >= count {
+		log.Printf(label+": address `%s` is out of range (%d file descriptor(s) passed by systemd)", addr, count)
+		return false
+	}
+	return true
+}
+
+// systemdListener returns a listener for the socket-activated file descriptor
+// named by addr.
+func systemdListener(addr string) (net.Listener, error) {
+	n, err := parseFDAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if n >= systemdFDCount() {
+		return nil, fmt.Errorf("file descriptor %s was not passed by systemd", addr)
+	}
+	// FileListener duplicates the descriptor, so the original can be closed
+	f := os.NewFile(uintptr(systemdFirstFD+n), addr)
+	defer f.Close()
+	return net.FileListener(f)
+}
@@ -0,0 +1,237 @@
+package goserve
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+)
+
+// Certificate is a TLS certificate and its private key.
+type Certificate struct {
+	CertFile string `yaml:"cert"`
+	KeyFile  string `yaml:"key"`
+}
+
+func (c Certificate) check(label string) (ok bool) {
+	ok = true
+	if _, err := os.Stat(c.CertFile); os.IsNotExist(err) {
+		log.Printf(label+": cert file `%s` does not exist", c.CertFile)
+		ok = false
+	}
+	if _, err := os.Stat(c.KeyFile); os.IsNotExist(err) {
+		log.Printf(label+": key file `%s` does not exist", c.KeyFile)
+		ok = false
+	}
+	return
+}
+
+// certificatePairs returns all of the listener's certificates, starting with
+// the one given by `cert` and `key`, if any.
+func (l Listener) certificatePairs() []Certificate {
+	var pairs []Certificate
+	if l.CertFile != "" || l.KeyFile != "" {
+		pairs = append(pairs, Certificate{l.CertFile, l.KeyFile})
+	}
+	return append(pairs, l.Certificates...)
+}
+
+// certificates holds a set of certificates, indexed by the host names they
+// are valid for. They can be reloaded from disk while in use.
+type certificates struct {
+	pairs []Certificate
+
+	mu    sync.RWMutex
+	certs []*tls.Certificate
+	names map[string]*tls.Certificate
+}
+
+// loadCertificates loads the given certificates.
+func loadCertificates(pairs []Certificate) (*certificates, error) {
+	c := &certificates{pairs: pairs}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload loads the certificates from disk again, such as after they have
+// been renewed. If any fail to load, the current certificates remain in use.
+func (c *certificates) reload() error {
+	var certs []*tls.Certificate
+	names := make(map[string]*tls.Certificate)
+	for _, pair := range c.pairs {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return err
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		hostnames := leaf.DNSNames
+		if len(hostnames) == 0 && leaf.Subject.CommonName != "" {
+			hostnames = []string{leaf.Subject.CommonName}
+		}
+		// Earlier certificates take precedence for names they share
+		for _, name := range hostnames {
+			name = strings.ToLower(name)
+			if _, found := names[name]; !found {
+				names[name] = &cert
+			}
+		}
+		certs = append(certs, &cert)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.certs, c.names = certs, names
+	return nil
+}
+
+// get returns the certificate for the server name requested by the client,
+// matching wildcard certificates, or the first certificate if none match.
+// It's suitable for use as a `tls.Config.GetCertificate` callback.
+func (c *certificates) get(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if cert, found := c.names[name]; found {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		if cert, found := c.names["*"+name[i:]]; found {
+			return cert, nil
+		}
+	}
+	return c.certs[0], nil
+}
+
+// tlsVersions maps the accepted `tls-min-version` values to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuiteID returns the ID of the named cipher suite. Only suites
+// considered secure by crypto/tls are recognised.
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+// clientAuthTypes maps the accepted `client-auth` values to the client
+// certificate policies they stand for.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"request": tls.RequestClientCert,          // ask for a certificate, but don't verify it
+	"verify":  tls.VerifyClientCertIfGiven,    // verify any certificate given
+	"require": tls.RequireAndVerifyClientCert, // reject clients without a valid certificate
+}
+
+// loadClientCAs reads a bundle of PEM-encoded CA certificates.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("no certificates found")
+	}
+	return pool, nil
+}
+
+func (l Listener) checkTLS(label string) (ok bool) {
+	ok = true
+	if l.Protocol != "https" {
+		if l.TLSMinVersion != "" || len(l.CipherSuites) > 0 || l.ClientCA != "" ||
+			l.ClientAuth != "" || l.ClientCertHeader != "" || l.DisableHTTP2 {
+			log.Println(label + ": TLS options supplied for non-HTTPS listener")
+			ok = false
+		}
+		return
+	}
+	if l.ClientAuth != "" {
+		if _, found := clientAuthTypes[l.ClientAuth]; !found {
+			log.Printf(label+": invalid client auth `%s` (expected request, verify or require)", l.ClientAuth)
+			ok = false
+		} else if l.ClientAuth != "request" && l.ClientCA == "" {
+			log.Printf(label+": client auth `%s` requires a client CA", l.ClientAuth)
+			ok = false
+		}
+	}
+	if l.ClientCA != "" {
+		if _, err := loadClientCAs(l.ClientCA); err != nil {
+			log.Printf(label+": invalid client CA `%s`: %s", l.ClientCA, err)
+			ok = false
+		}
+	}
+	if strings.ContainsAny(l.ClientCertHeader, " \t:") {
+		log.Printf(label+": invalid client cert header `%s`", l.ClientCertHeader)
+		ok = false
+	} else if l.ClientCertHeader != "" && l.ClientCA == "" {
+		log.Println(label + ": client cert header requires a client CA, as only verified certificates are used")
+		ok = false
+	}
+	if _, found := tlsVersions[l.TLSMinVersion]; l.TLSMinVersion != "" && !found {
+		log.Printf(label+": unknown TLS version `%s`", l.TLSMinVersion)
+		ok = false
+	}
+	for _, name := range l.CipherSuites {
+		if _, found := cipherSuiteID(name); !found {
+			log.Printf(label+": unknown or insecure cipher suite `%s`", name)
+			ok = false
+		}
+	}
+	return
+}
+
+// tlsConfig returns the TLS configuration for the listener, or nil if it
+// isn't an HTTPS listener. Its certificates (or ACME manager) must already
+// have been set up.
+func (l Listener) tlsConfig() *tls.Config {
+	c := &tls.Config{MinVersion: tlsVersions[l.TLSMinVersion]}
+	if l.acmeManager != nil {
+		c.GetCertificate = l.acmeManager.GetCertificate
+		c.NextProtos = []string{acme.ALPNProto} // for TLS-ALPN-01 challenges
+	} else if l.certs != nil {
+		c.GetCertificate = l.certs.get
+	} else {
+		return nil
+	}
+	for _, name := range l.CipherSuites {
+		id, _ := cipherSuiteID(name)
+		c.CipherSuites = append(c.CipherSuites, id)
+	}
+	c.ClientAuth = clientAuthTypes[l.ClientAuth]
+	c.ClientCAs = l.clientCAs
+	return c
+}
+
+// ClientCertHandler sets the request header of the given name to the common
+// name of the client's verified certificate, if any, before passing requests
+// on to h. Any value sent by the client is removed, so it can't be forged.
+func ClientCertHandler(h http.Handler, header string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(header)
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+				r.Header.Set(header, cn)
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,139 @@
+package goserve
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate for name, and its key,
+// to the given files.
+func writeCertificate(t *testing.T, name string, pair Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificatesReload(t *testing.T) {
+	dir := t.TempDir()
+	pair := Certificate{filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")}
+	writeCertificate(t, "old.example.com", pair)
+	certs, err := loadCertificates([]Certificate{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{GetCertificate: certs.get}
+	ts.StartTLS()
+	defer ts.Close()
+	// A new connection, and so handshake, for each request. The server name
+	// makes the test server use certs, rather than its own certificate.
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true, ServerName: "example.com"},
+		DisableKeepAlives: true,
+	}}
+	served := func() string {
+		t.Helper()
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if got := served(); got != "old.example.com" {
+		t.Fatalf("got certificate for %s", got)
+	}
+	writeCertificate(t, "new.example.com", pair)
+	if got := served(); got != "old.example.com" {
+		t.Errorf("before reload, got certificate for %s", got)
+	}
+	if err := certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := served(); got != "new.example.com" {
+		t.Errorf("after reload, got certificate for %s", got)
+	}
+
+	// A broken certificate leaves the current one in use
+	ioutil.WriteFile(pair.CertFile, []byte("not a certificate"), 0644)
+	if err := certs.reload(); err == nil {
+		t.Error("reloaded broken certificate")
+	}
+	if got := served(); got != "new.example.com" {
+		t.Errorf("after failed reload, got certificate for %s", got)
+	}
+}
+
+func TestDisableHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	pair := Certificate{filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")}
+	writeCertificate(t, "example.com", pair)
+	srv := newTestServer(t, ServerConfig{
+		Listeners: []Listener{
+			{Protocol: "https", Addr: "127.0.0.1:0", CertFile: pair.CertFile, KeyFile: pair.KeyFile},
+			{Protocol: "https", Addr: "localhost:0", CertFile: pair.CertFile, KeyFile: pair.KeyFile, DisableHTTP2: true},
+		},
+		Serves: []Serve{{Path: "/", Target: dir}},
+	})
+	if err := srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Shutdown(context.Background())
+
+	negotiated := func(b binding) string {
+		t.Helper()
+		conn, err := tls.Dial("tcp", b.ln.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "http/1.1"},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().NegotiatedProtocol
+	}
+	if got := negotiated(srv.bindings[0]); got != "h2" {
+		t.Errorf("with HTTP/2, negotiated %q", got)
+	}
+	if got := negotiated(srv.bindings[1]); got != "http/1.1" {
+		t.Errorf("without HTTP/2, negotiated %q", got)
+	}
+}
@@ -0,0 +1,12 @@
+package goserve
+
+// Version is the version of goserve, as reported in the Server header of
+// health check and metrics responses. The goserve command sets it from its
+// build information.
+var Version = "dev"
+
+// serverHeader is the value of the Server header on goserve's own responses,
+// such as health checks and metrics.
+func serverHeader() string {
+	return "goserve/" + Version
+}
@@ -0,0 +1,196 @@
+package goserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// zipTargetPrefix begins targets naming zip archives to serve files from,
+// e.g. "zip:///srv/site.zip".
+const zipTargetPrefix = "zip://"
+
+// isZipTarget returns true if target names a zip archive.
+func isZipTarget(target string) bool {
+	return strings.HasPrefix(target, zipTargetPrefix)
+}
+
+// ZipFS is a read-only file system serving the contents of a zip archive.
+// Directories are implied by the paths of the files within them, whether or
+// not the archive has entries for them.
+type ZipFS struct {
+	f     *os.File
+	files map[string]*zip.File     // by path, e.g. "/css/site.css"
+	dirs  map[string][]os.FileInfo // directory path to its contents
+}
+
+// OpenZipFS opens the named zip archive and indexes its contents. The
+// archive stays open until the file system is closed.
+func OpenZipFS(name string) (*ZipFS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := zip.NewReader(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	z := &ZipFS{
+		f:     f,
+		files: make(map[string]*zip.File),
+		dirs:  map[string][]os.FileInfo{"/": nil},
+	}
+	for _, zf := range r.File {
+		name := path.Clean("/" + zf.Name)
+		if strings.HasSuffix(zf.Name, "/") {
+			z.addDir(name)
+			continue
+		}
+		if _, found := z.files[name]; found {
+			continue // the first of duplicate entries wins
+		}
+		z.files[name] = zf
+		z.addDir(path.Dir(name))
+		z.dirs[path.Dir(name)] = append(z.dirs[path.Dir(name)], zf.FileInfo())
+	}
+	for _, fis := range z.dirs {
+		sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	}
+	return z, nil
+}
+
+// addDir records the directory name, and those containing it, if they aren't
+// already known.
+func (z *ZipFS) addDir(name string) {
+	for name != "/" {
+		if _, found := z.dirs[name]; found {
+			return
+		}
+		z.dirs[name] = nil
+		parent := path.Dir(name)
+		z.dirs[parent] = append(z.dirs[parent], zipDirInfo(path.Base(name)))
+		name = parent
+	}
+}
+
+// Close closes the archive.
+func (z *ZipFS) Close() error {
+	return z.f.Close()
+}
+
+// Open opens the named file or directory. Files are described by the
+// archive's central directory, and only decompressed once read from.
+func (z *ZipFS) Open(name string) (http.File, error) {
+	name = path.Clean("/" + name)
+	if fis, found := z.dirs[name]; found {
+		return &zipFile{
+			r:       bytes.NewReader(nil),
+			fi:      zipDirInfo(path.Base(name)),
+			entries: fis,
+		}, nil
+	}
+	zf, found := z.files[name]
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	return &zipFile{zf: zf, fi: zf.FileInfo()}, nil
+}
+
+// zipFile is a file or directory opened from a ZipFS.
+type zipFile struct {
+	zf      *zip.File     // nil for directories
+	r       *bytes.Reader // the file's contents, once read
+	fi      os.FileInfo
+	entries []os.FileInfo // directory contents not yet read
+}
+
+// reader returns the reader of the file's contents, decompressing them in
+// full the first time, as they must be seekable.
+func (f *zipFile) reader() (*bytes.Reader, error) {
+	if f.r != nil {
+		return f.r, nil
+	}
+	rc, err := f.zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	f.r = bytes.NewReader(b)
+	return f.r, nil
+}
+
+func (f *zipFile) Read(b []byte) (int, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(b)
+}
+
+func (f *zipFile) Seek(offset int64, whence int) (int64, error) {
+	r, err := f.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Seek(offset, whence)
+}
+
+func (f *zipFile) Close() error {
+	return nil
+}
+
+func (f *zipFile) Stat() (os.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *zipFile) Readdir(count int) ([]os.FileInfo, error) {
+	if count <= 0 || count > len(f.entries) {
+		if count > 0 && len(f.entries) == 0 {
+			return nil, io.EOF
+		}
+		count = len(f.entries)
+	}
+	fis := f.entries[:count]
+	f.entries = f.entries[count:]
+	return fis, nil
+}
+
+// zipDirInfo describes a directory within a ZipFS by its name.
+type zipDirInfo string
+
+func (d zipDirInfo) Name() string       { return string(d) }
+func (d zipDirInfo) Size() int64        { return 0 }
+func (d zipDirInfo) Mode() os.FileMode  { return os.ModeDir | 0555 }
+func (d zipDirInfo) ModTime() time.Time { return time.Time{} }
+func (d zipDirInfo) IsDir() bool        { return true }
+func (d zipDirInfo) Sys() interface{}   { return nil }
+
+// checkZipTarget returns true if target names a readable zip archive.
+func checkZipTarget(label, target string) (ok bool) {
+	z, err := OpenZipFS(strings.TrimPrefix(target, zipTargetPrefix))
+	if err != nil {
+		log.Printf(label+": invalid zip target %s: %s", target, err)
+		return false
+	}
+	z.Close()
+	return true
+}
@@ -0,0 +1,96 @@
+package goserve
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// writeZip writes an archive of the given files, stored uncompressed, and
+// returns its path.
+func writeZip(t *testing.T, files map[string]string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "site.zip")
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestZipServe(t *testing.T) {
+	name := writeZip(t, map[string]string{
+		"index.html":   "home",
+		"css/site.css": "body{}",
+	})
+	h := testHandler(t, ServerConfig{
+		Serves: []Serve{{Path: "/", Target: zipTargetPrefix + name}},
+	})
+	if w := get(h, "GET", "/"); w.Code != http.StatusOK || w.Body.String() != "home" {
+		t.Errorf("index: got %d %q", w.Code, w.Body.String())
+	}
+	if w := get(h, "GET", "/css/site.css", "Range", "bytes=1-3"); w.Code != http.StatusPartialContent || w.Body.String() != "ody" {
+		t.Errorf("range: got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestZipOpenIsLazy(t *testing.T) {
+	content := "the quick brown fox"
+	name := writeZip(t, map[string]string{"fox.txt": content})
+	// Corrupt the stored content, so it fails its checksum when read
+	b, _ := ioutil.ReadFile(name)
+	i := bytes.Index(b, []byte(content))
+	b[i] ^= 0xff
+	ioutil.WriteFile(name, b, 0644)
+
+	z, err := OpenZipFS(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer z.Close()
+	if !isFile(z, "/fox.txt") || !exists(z, "/fox.txt") {
+		t.Error("corrupt file was read to check it exists")
+	}
+	f, err := z.Open("/fox.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.Size() != int64(len(content)) {
+		t.Errorf("Stat: got %v, %v", fi, err)
+	}
+	if _, err := ioutil.ReadAll(f); err == nil {
+		t.Error("reading corrupt file succeeded")
+	}
+}
+
+func TestZipClose(t *testing.T) {
+	z, err := OpenZipFS(writeZip(t, map[string]string{"a.txt": "a"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := z.Open("/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(f); err == nil {
+		t.Error("read from closed archive")
+	}
+}